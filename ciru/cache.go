@@ -0,0 +1,249 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type (
+	// Cache is a size bounded LRU cache with ttl, concurrent fetches of the same key are coalesced
+	Cache struct {
+		*sync.Mutex
+
+		name        string
+		size        int
+		ttl         time.Duration
+		negativeTTL time.Duration
+		// returns true for errors which mean that the key does not exist,
+		// they are cached with the negative ttl
+		isNegative func(err error) bool
+
+		// key: cache key
+		entries map[string]*list.Element
+		// most recently used entry first
+		lru *list.List
+		// key: cache key
+		calls map[string]*CacheCall
+
+		stats CacheStats
+	}
+
+	CacheEntry struct {
+		key       string
+		value     interface{}
+		err       error
+		expiresAt time.Time
+	}
+
+	CacheCall struct {
+		// closed when the fetch is done
+		done  chan bool
+		value interface{}
+		err   error
+	}
+
+	CacheStats struct {
+		Size         int   `json:"size"`
+		Hits         int64 `json:"hits"`
+		NegativeHits int64 `json:"negativeHits"`
+		Misses       int64 `json:"misses"`
+		Coalesced    int64 `json:"coalesced"`
+		Evictions    int64 `json:"evictions"`
+	}
+)
+
+var (
+	cachesMutex = &sync.Mutex{}
+	// key: cache name
+	caches = make(map[string]*Cache)
+)
+
+func newCache(name string, size int, ttl time.Duration, negativeTTL time.Duration, isNegative func(err error) bool) *Cache {
+	cache := &Cache{
+		Mutex:       &sync.Mutex{},
+		name:        name,
+		size:        size,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		isNegative:  isNegative,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+		calls:       make(map[string]*CacheCall),
+	}
+
+	cachesMutex.Lock()
+	caches[name] = cache
+	cachesMutex.Unlock()
+
+	return cache
+}
+
+// get returns the cached value of the key, on a miss fetch is called once for all concurrent callers
+func (cache *Cache) get(key string, fetch func() (interface{}, error)) (interface{}, error) {
+	cache.Lock()
+	if element, ok := cache.entries[key]; ok {
+		entry := element.Value.(*CacheEntry)
+		if time.Now().Before(entry.expiresAt) {
+			cache.lru.MoveToFront(element)
+			if entry.err != nil {
+				cache.stats.NegativeHits++
+			} else {
+				cache.stats.Hits++
+			}
+			cache.Unlock()
+			return entry.value, entry.err
+		}
+
+		cache.removeElement(element)
+	}
+
+	cache.stats.Misses++
+
+	if call, ok := cache.calls[key]; ok {
+		cache.stats.Coalesced++
+		cache.Unlock()
+
+		<-call.done
+		return call.value, call.err
+	}
+
+	call := &CacheCall{
+		done: make(chan bool),
+	}
+	cache.calls[key] = call
+	cache.Unlock()
+
+	call.value, call.err = fetch()
+
+	cache.Lock()
+	delete(cache.calls, key)
+	if call.err == nil {
+		cache.setLocked(key, call.value, nil, cache.ttl)
+	} else if cache.isNegative != nil && cache.isNegative(call.err) {
+		cache.setLocked(key, nil, call.err, cache.negativeTTL)
+	}
+	cache.Unlock()
+
+	close(call.done)
+
+	return call.value, call.err
+}
+
+// cached returns the cached value of the key without blocking. On a miss fetch is started
+// in the background, unless it is already running, and false is returned.
+func (cache *Cache) cached(key string, fetch func() (interface{}, error)) (interface{}, bool) {
+	cache.Lock()
+	if element, ok := cache.entries[key]; ok {
+		entry := element.Value.(*CacheEntry)
+		if time.Now().Before(entry.expiresAt) {
+			cache.lru.MoveToFront(element)
+			if entry.err != nil {
+				cache.stats.NegativeHits++
+			} else {
+				cache.stats.Hits++
+			}
+			cache.Unlock()
+			return entry.value, entry.err == nil
+		}
+	}
+	_, running := cache.calls[key]
+	cache.Unlock()
+
+	if !running {
+		go cache.get(key, fetch)
+	}
+
+	return nil, false
+}
+
+// set replaces the value of the key, e.g. after the data was refreshed
+func (cache *Cache) set(key string, value interface{}) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	cache.setLocked(key, value, nil, cache.ttl)
+}
+
+// setLocked adds the entry and evicts the least recently used entries, the cache has to be locked
+func (cache *Cache) setLocked(key string, value interface{}, err error, ttl time.Duration) {
+	if element, ok := cache.entries[key]; ok {
+		cache.removeElement(element)
+	}
+
+	cache.entries[key] = cache.lru.PushFront(&CacheEntry{
+		key:       key,
+		value:     value,
+		err:       err,
+		expiresAt: time.Now().Add(ttl),
+	})
+
+	for cache.size > 0 && cache.lru.Len() > cache.size {
+		cache.removeElement(cache.lru.Back())
+		cache.stats.Evictions++
+	}
+}
+
+// removeElement removes the entry from the cache, the cache has to be locked
+func (cache *Cache) removeElement(element *list.Element) {
+	cache.lru.Remove(element)
+	delete(cache.entries, element.Value.(*CacheEntry).key)
+}
+
+func (cache *Cache) invalidate(key string) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	if element, ok := cache.entries[key]; ok {
+		cache.removeElement(element)
+	}
+}
+
+// clean removes all expired entries
+func (cache *Cache) clean() {
+	cache.Lock()
+	defer cache.Unlock()
+
+	now := time.Now()
+	for _, element := range cache.entries {
+		if now.After(element.Value.(*CacheEntry).expiresAt) {
+			cache.removeElement(element)
+		}
+	}
+}
+
+func (cache *Cache) statistics() CacheStats {
+	cache.Lock()
+	defer cache.Unlock()
+
+	stats := cache.stats
+	stats.Size = cache.lru.Len()
+
+	return stats
+}
+
+// cleanCaches removes the expired entries of all caches
+func cleanCaches() {
+	cachesMutex.Lock()
+	defer cachesMutex.Unlock()
+
+	for _, cache := range caches {
+		cache.clean()
+	}
+}
+
+// cacheStatsHandler returns the statistics of all caches as json
+func cacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := make(map[string]CacheStats)
+
+	cachesMutex.Lock()
+	for name, cache := range caches {
+		stats[name] = cache.statistics()
+	}
+	cachesMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
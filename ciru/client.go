@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -19,17 +20,31 @@ const (
 	pingPeriod = (pongWait * 9) / 10
 
 	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	maxMessageSize = 2048
 )
 
 type (
 	Client struct {
 		conn *websocket.Conn
 		send chan []byte
+		// closed by the hub when the client is unregistered, send is never closed
+		// because the hub can still be sending to it
+		done chan bool
+		// background color of the overlay, name colors are adjusted to be readable on it
+		background string
+		// empty if the client did not authenticate with a moderation api token
+		moderator string
 	}
 
 	ClientMessage struct {
 		Content string `json:"content"`
+		// optional, messages are sent to the default channel if it is empty
+		Channel string `json:"channel"`
+		// optional, sets the background color of the overlay, e.g. #ffffff
+		Background string `json:"background"`
+		// optional, moderation api token which allows the client to send moderation actions
+		Token      string                  `json:"token"`
+		Moderation *TwitchModerationAction `json:"moderation"`
 	}
 )
 
@@ -68,10 +83,66 @@ func (client *Client) read() {
 
 		log.Debug("Receiving message from client ", client.conn.LocalAddr().String, ": ", clientMessage.Content)
 
-		twitch.twirgo.SendMessage(twitch.twirgo.Options().DefaultChannel, clientMessage.Content)
+		if clientMessage.Background != "" {
+			hugo.hub.setBackground(client, clientMessage.Background)
+		}
+		if clientMessage.Token != "" {
+			hugo.hub.setModerator(client, twitch.moderation.authenticateModerator(clientMessage.Token))
+		}
+		if clientMessage.Moderation != nil {
+			go client.executeModerationAction(*clientMessage.Moderation)
+		}
+		if clientMessage.Content == "" {
+			continue
+		}
+
+		// chat commands like /ban are moderation actions
+		content := strings.TrimSpace(clientMessage.Content)
+		if strings.HasPrefix(content, "/") || strings.HasPrefix(content, ".") {
+			hugo.hub.RLock()
+			moderator := client.moderator
+			hugo.hub.RUnlock()
+
+			if moderator == "" {
+				log.Error("Client without moderation api token wants to send the command: ", content)
+				continue
+			}
+		}
+
+		channel := twitch.defaultChannel()
+		if clientMessage.Channel != "" {
+			channel = twitch.channel(clientMessage.Channel)
+		}
+		if channel == nil {
+			log.Error("Client wants to send a message to unknown channel: ", clientMessage.Channel)
+			continue
+		}
+
+		twitch.say(channel, clientMessage.Content, chatPriorityCommand)
 	}
 }
 
+// executeModerationAction runs the action if the client is authenticated and sends the result back to it
+func (client *Client) executeModerationAction(action TwitchModerationAction) {
+	hugo.hub.RLock()
+	moderator := client.moderator
+	hugo.hub.RUnlock()
+
+	var result TwitchModerationActionResult
+	if moderator == "" {
+		log.Error("Client without moderation api token wants to execute ", action.Action)
+		result = TwitchModerationActionResult{
+			Action:     action,
+			Error:      "unauthorized",
+			ExecutedAt: time.Now(),
+		}
+	} else {
+		result, _ = twitch.executeModerationAction(moderator, action)
+	}
+
+	hugo.hub.send(client, result.Action.Channel, result)
+}
+
 func (client *Client) write() {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
@@ -81,13 +152,13 @@ func (client *Client) write() {
 
 	for {
 		select {
-		case message, ok := <-client.send:
+		case <-client.done:
+			// The hub unregistered the client
+			client.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			client.conn.WriteMessage(websocket.CloseMessage, []byte{})
+			return
+		case message := <-client.send:
 			client.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// The hub closed the channel
-				client.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
 
 			w, err := client.conn.NextWriter(websocket.TextMessage)
 			if err != nil {
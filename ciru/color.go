@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const defaultOverlayBackground = "#18181b"
+
+// normalizeColor returns the color as lowercase #rrggbb or an empty string if it is invalid
+func normalizeColor(color string) string {
+	color = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(color), "#"))
+	if len(color) == 3 {
+		color = string([]byte{color[0], color[0], color[1], color[1], color[2], color[2]})
+	}
+
+	if len(color) != 6 {
+		return ""
+	}
+	if _, err := strconv.ParseUint(color, 16, 32); err != nil {
+		return ""
+	}
+
+	return "#" + color
+}
+
+func parseColor(color string) (r, g, b float64, ok bool) {
+	color = normalizeColor(color)
+	if color == "" {
+		return 0, 0, 0, false
+	}
+
+	rgb, _ := strconv.ParseUint(color[1:], 16, 32)
+	return float64(rgb >> 16 & 0xff), float64(rgb >> 8 & 0xff), float64(rgb & 0xff), true
+}
+
+func formatColor(r, g, b float64) string {
+	return fmt.Sprintf("#%02x%02x%02x", int(math.Round(r)), int(math.Round(g)), int(math.Round(b)))
+}
+
+// relativeLuminance as defined by WCAG 2
+func relativeLuminance(r, g, b float64) float64 {
+	linear := func(c float64) float64 {
+		c /= 255
+		if c <= 0.03928 {
+			return c / 12.92
+		}
+		return math.Pow((c+0.055)/1.055, 2.4)
+	}
+
+	return 0.2126*linear(r) + 0.7152*linear(g) + 0.0722*linear(b)
+}
+
+func contrastRatio(l1, l2 float64) float64 {
+	if l1 < l2 {
+		l1, l2 = l2, l1
+	}
+
+	return (l1 + 0.05) / (l2 + 0.05)
+}
+
+// readableColor lightens or darkens the color as little as possible until it has the
+// minimum contrast ratio of COLOR_CONTRAST_RATIO against the background
+func readableColor(color string, background string) string {
+	r, g, b, ok := parseColor(color)
+	if !ok {
+		return color
+	}
+
+	if normalizeColor(background) == "" {
+		background = os.Getenv("OVERLAY_BACKGROUND")
+	}
+	bgR, bgG, bgB, ok := parseColor(background)
+	if !ok {
+		bgR, bgG, bgB, _ = parseColor(defaultOverlayBackground)
+	}
+
+	minRatio := 4.5
+	if f, err := strconv.ParseFloat(os.Getenv("COLOR_CONTRAST_RATIO"), 64); err == nil && f >= 1 && f <= 21 {
+		minRatio = f
+	}
+
+	bgLuminance := relativeLuminance(bgR, bgG, bgB)
+	if contrastRatio(relativeLuminance(r, g, b), bgLuminance) >= minRatio {
+		return normalizeColor(color)
+	}
+
+	// mix the color with white on dark and with black on light backgrounds,
+	// the other direction is only used if the ratio can not be reached
+	targets := []float64{255, 0}
+	if bgLuminance > 0.5 {
+		targets = []float64{0, 255}
+	}
+
+	best := normalizeColor(color)
+	bestRatio := 0.0
+	for _, target := range targets {
+		mix := func(t float64) (float64, float64, float64) {
+			return r + (target-r)*t, g + (target-g)*t, b + (target-b)*t
+		}
+
+		if ratio := contrastRatio(relativeLuminance(mix(1)), bgLuminance); ratio < minRatio {
+			if ratio > bestRatio {
+				best, bestRatio = formatColor(mix(1)), ratio
+			}
+			continue
+		}
+
+		// smallest mix which reaches the minimum ratio
+		low, high := 0.0, 1.0
+		for i := 0; i < 16; i++ {
+			t := (low + high) / 2
+			if contrastRatio(relativeLuminance(mix(t)), bgLuminance) >= minRatio {
+				high = t
+			} else {
+				low = t
+			}
+		}
+
+		// rounding to hex can lose a bit of contrast
+		adjusted := formatColor(mix(high))
+		for high < 1 {
+			adjustedR, adjustedG, adjustedB, _ := parseColor(adjusted)
+			if contrastRatio(relativeLuminance(adjustedR, adjustedG, adjustedB), bgLuminance) >= minRatio {
+				break
+			}
+			high = math.Min(high+1.0/255, 1)
+			adjusted = formatColor(mix(high))
+		}
+
+		return adjusted
+	}
+
+	return best
+}
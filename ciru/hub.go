@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"strings"
 	"sync"
 )
 
@@ -12,8 +13,9 @@ type (
 	}
 
 	Data struct {
-		Type string      `json:"type"`
-		Data interface{} `json:"data"`
+		Type    string      `json:"type"`
+		Channel string      `json:"channel"`
+		Data    interface{} `json:"data"`
 	}
 )
 
@@ -38,11 +40,12 @@ func (hub *Hub) unregisterClient(client *Client) {
 	if _, ok := hub.clients[client]; ok {
 		log.Debug("Unregister new client")
 		delete(hub.clients, client)
-		close(client.send)
+		close(client.done)
 	}
 }
 
-func (hub *Hub) broadcast(data interface{}) {
+// dataType returns the type of the data for the clients or an empty string if it can not be sent
+func dataType(data interface{}) string {
 	var t string
 	switch d := data.(type) {
 	case TwitchMessage:
@@ -55,25 +58,136 @@ func (hub *Hub) broadcast(data interface{}) {
 		t = d.Type
 	case TwitchPubSubMessageSub:
 		t = "sub"
-	default:
+	case TwitchSubscriptions:
+		t = "subcount"
+	case TwitchStreamEvent:
+		t = d.event
+	case TwitchEventSubEvent:
+		t = d.Type
+	case TwitchFollow:
+		t = "follow"
+	case TwitchFollowBurst:
+		t = "follow:burst"
+	case TwitchRaid:
+		t = "raid"
+	case TwitchPoll:
+		t = d.event
+	case TwitchPrediction:
+		t = d.event
+	case TwitchHypeTrain:
+		t = "hypetrain"
+	case TwitchModerationEvent:
+		t = "moderation"
+	case TwitchRaidProtection:
+		t = "raidprotection"
+	case TwitchNewUser:
+		t = "user:new"
+	case TwitchModerationActionResult:
+		t = "moderation:result"
+	}
+
+	return t
+}
+
+// broadcast sends the data to all clients, channel is the name
+// of the Twitch channel the data belongs to
+func (hub *Hub) broadcast(channel string, data interface{}) {
+	t := dataType(data)
+	if t == "" {
 		log.Error("Got invalid type to broadcast")
 		return
 	}
 
 	d := Data{
-		Type: t,
-		Data: data,
+		Type:    t,
+		Channel: strings.ToLower(strings.TrimPrefix(channel, "#")),
+		Data:    data,
+	}
+
+	hub.RLock()
+	clients := make(map[*Client]string, len(hub.clients))
+	for client := range hub.clients {
+		clients[client] = client.background
+	}
+	hub.RUnlock()
+
+	// key: background color of the clients
+	payloads := make(map[string][]byte)
+	for client, background := range clients {
+		payload, ok := payloads[background]
+		if !ok {
+			var err error
+			payload, err = hub.marshal(d, background)
+			if err != nil {
+				log.Error(err)
+				return
+			}
+			payloads[background] = payload
+			log.Debug("Broadcast message: ", string(payload))
+		}
+
+		select {
+		case client.send <- payload:
+			log.Debug("Queued data for: ", client.conn.UnderlyingConn().RemoteAddr().String)
+		case <-client.done:
+		}
+	}
+}
+
+// marshal adds the name color which is readable on the background of the client to chat messages
+func (hub *Hub) marshal(d Data, background string) ([]byte, error) {
+	if m, ok := d.Data.(TwitchMessage); ok {
+		m.User.AdjustedColor = readableColor(m.User.Color, background)
+		d.Data = m
+	}
+
+	return json.Marshal(d)
+}
+
+// setBackground sets the background color of the overlay of the client,
+// an empty color resets it to OVERLAY_BACKGROUND
+func (hub *Hub) setBackground(client *Client, background string) {
+	hub.Lock()
+	client.background = normalizeColor(background)
+	hub.Unlock()
+}
+
+// send sends the data only to the client, e.g. as response to its request
+func (hub *Hub) send(client *Client, channel string, data interface{}) {
+	t := dataType(data)
+	if t == "" {
+		log.Error("Got invalid type to send")
+		return
+	}
+
+	hub.RLock()
+	_, ok := hub.clients[client]
+	background := client.background
+	hub.RUnlock()
+
+	if !ok {
+		return
 	}
 
-	json, err := json.Marshal(d)
+	payload, err := hub.marshal(Data{
+		Type:    t,
+		Channel: strings.ToLower(strings.TrimPrefix(channel, "#")),
+		Data:    data,
+	}, background)
 	if err != nil {
 		log.Error(err)
 		return
 	}
 
-	log.Debug("Broadcast message: ", string(json))
-	for client := range hub.clients {
-		client.send <- []byte(json)
-		log.Debug("Queued data for: ", client.conn.UnderlyingConn().RemoteAddr().String)
+	select {
+	case client.send <- payload:
+	case <-client.done:
 	}
 }
+
+// setModerator sets the moderator of the client, an empty moderator revokes its moderation actions
+func (hub *Hub) setModerator(client *Client, moderator string) {
+	hub.Lock()
+	client.moderator = moderator
+	hub.Unlock()
+}
@@ -33,6 +33,11 @@ func (hugo *Hugo) Serve(w http.ResponseWriter, r *http.Request) {
 	client := &Client{
 		conn: conn,
 		send: make(chan []byte),
+		done: make(chan bool),
+		// e.g. /ws?background=%23ffffff
+		background: normalizeColor(r.URL.Query().Get("background")),
+		// e.g. /ws?token=secret for moderation actions
+		moderator: twitch.moderation.authenticateModerator(r.URL.Query().Get("token")),
 	}
 
 	log.Info("New connection from client: ", conn.LocalAddr().String)
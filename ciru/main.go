@@ -3,6 +3,10 @@ package main
 import (
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -29,17 +33,61 @@ func main() {
 
 	cron = newCron()
 
+	hugo = newHugo()
+
 	// connect to twitch chat and register messageReceived method
 	twitch = newTwitch()
-
-	hugo = newHugo()
+	twitch.start()
 
 	http.HandleFunc("/ws", hugo.Serve)
 	http.HandleFunc("/login", twitch.loginHandler)
 	http.HandleFunc("/return", twitch.returnHandler)
+	http.HandleFunc("/status", twitch.statusHandler)
 
 	http.HandleFunc("/subcount", twitch.subcountHandler)
+	http.HandleFunc("/eventsub", twitch.eventSub.handler)
+	http.HandleFunc("/cache", cacheStatsHandler)
+	http.HandleFunc("/moderation", twitch.moderationHandler)
+
+	// queued balance changes and activities would be lost otherwise
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+
+		log.Info("Shutting down")
+		steveBalances.close()
+		steveActivities.close()
+		os.Exit(0)
+	}()
 
 	log.Info("Listening on: ", os.Getenv("WS_PORT"))
 	log.Fatal(http.ListenAndServe(":"+os.Getenv("WS_PORT"), nil))
 }
+
+// envInt returns the env var as int or def if it is not set or invalid
+func envInt(name string, def int) int {
+	if i, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return i
+	}
+
+	return def
+}
+
+// envFloat returns the env var as float or def if it is not set or invalid
+func envFloat(name string, def float64) float64 {
+	if f, err := strconv.ParseFloat(os.Getenv(name), 64); err == nil {
+		return f
+	}
+
+	return def
+}
+
+// envDuration returns the env var as duration, e.g. 5m, or def if it is not set or invalid
+func envDuration(name string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(name)); err == nil && d > 0 {
+		return d
+	}
+
+	return def
+}
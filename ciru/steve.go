@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// balance changes within this window are sent with one request
+	steveBalancesWindow = time.Second
+	// maximum balance changes per request
+	steveBalancesLimit = 500
+	// failed requests are retried with an exponential backoff up to this delay
+	steveBalancesMaxRetryDelay = time.Minute
+	// activities within this window are sent with one request
+	steveActivitiesWindow = 5 * time.Second
+)
+
+type (
+	SteveBalanceChange struct {
+		Username         string `json:"username"`
+		TwitchID         string `json:"twitchID"`
+		Taler            int    `json:"taler"`
+		ReputationPoints int    `json:"reputationPoints"`
+	}
+
+	SteveBalanceChangeResult struct {
+		Username string `json:"username"`
+		// set if the change was skipped
+		Error string `json:"error"`
+	}
+
+	SteveBalances struct {
+		*sync.Mutex
+
+		// key: username
+		changes map[string]*SteveBalanceChange
+		timer   *time.Timer
+		// 0 if the last request succeeded
+		retryDelay time.Duration
+	}
+
+	SteveActivityChange struct {
+		Username string `json:"username"`
+		TwitchID string `json:"twitchID"`
+		TwitchUserActivity
+	}
+
+	SteveActivities struct {
+		*sync.Mutex
+
+		// key: username and stream session id, the stream attendance is counted per session
+		changes map[string]*SteveActivityChange
+		timer   *time.Timer
+		// 0 if the last request succeeded
+		retryDelay time.Duration
+	}
+)
+
+var (
+	errSteveNotFound   = errors.New("steve: not found")
+	errSteveBadRequest = errors.New("steve: bad request")
+
+	steveHTTPClient = &http.Client{
+		Timeout: 3 * time.Second,
+	}
+
+	steveBalances = &SteveBalances{
+		Mutex:   &sync.Mutex{},
+		changes: make(map[string]*SteveBalanceChange),
+	}
+
+	steveActivities = &SteveActivities{
+		Mutex:   &sync.Mutex{},
+		changes: make(map[string]*SteveActivityChange),
+	}
+)
+
+func steveURL(path string) string {
+	return strings.Trim(os.Getenv("STEVE_URL"), " /") + path
+}
+
+// steveRequest sends body as json to the data service and unmarshals the response into v.
+// body and v can be nil.
+func steveRequest(method string, path string, body interface{}, v interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, steveURL(path), reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := steveHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Steve request %s %s: %d %s", method, path, res.StatusCode, resBody)
+
+	if res.StatusCode == http.StatusNotFound {
+		return errSteveNotFound
+	} else if res.StatusCode == http.StatusBadRequest {
+		return errSteveBadRequest
+	} else if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.New("steve: got " + res.Status + " as response")
+	}
+
+	if v == nil || len(resBody) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(resBody, v)
+}
+
+// steveUserPath returns the path of the user endpoint, the twitch user id
+// lets steve find the user even if they changed their username
+func steveUserPath(username string, userID string, subTarget string, query url.Values) string {
+	path := "/user/" + url.PathEscape(username)
+	if subTarget != "" {
+		path += "/" + subTarget
+	}
+
+	if query == nil {
+		query = url.Values{}
+	}
+	if userID != "" {
+		query.Set("twitch_id", userID)
+	}
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	return path
+}
+
+func addReputationPointsToUser(username string, userID string, reputationPoints int) {
+	steveBalances.add(username, userID, 0, reputationPoints)
+}
+
+// add queues the taler and reputation points for the user,
+// e.g. the changes of a gift bomb are sent with one request
+func (balances *SteveBalances) add(username string, userID string, taler int, reputationPoints int) {
+	username = strings.ToLower(strings.TrimSpace(username))
+	if username == "" {
+		return
+	}
+
+	balances.Lock()
+	defer balances.Unlock()
+
+	balances.merge(SteveBalanceChange{
+		Username:         username,
+		TwitchID:         userID,
+		Taler:            taler,
+		ReputationPoints: reputationPoints,
+	})
+
+	// the queue is only sent early while steve is reachable
+	if len(balances.changes) >= steveBalancesLimit && balances.retryDelay == 0 {
+		balances.flushLocked()
+	} else if balances.timer == nil {
+		balances.timer = time.AfterFunc(steveBalancesWindow, balances.flush)
+	}
+}
+
+// merge adds the change to the queued changes of the user, balances has to be locked
+func (balances *SteveBalances) merge(c SteveBalanceChange) {
+	change, ok := balances.changes[c.Username]
+	if !ok {
+		change = &SteveBalanceChange{Username: c.Username}
+		balances.changes[c.Username] = change
+	}
+	if c.TwitchID != "" && change.TwitchID == "" {
+		change.TwitchID = c.TwitchID
+	}
+	change.Taler += c.Taler
+	change.ReputationPoints += c.ReputationPoints
+}
+
+func (balances *SteveBalances) flush() {
+	balances.Lock()
+	defer balances.Unlock()
+
+	balances.flushLocked()
+}
+
+// flushLocked sends the queued changes, balances has to be locked
+func (balances *SteveBalances) flushLocked() {
+	changes := balances.takeLocked()
+	if len(changes) == 0 {
+		return
+	}
+
+	go func() {
+		if err := balances.send(changes); err != nil {
+			balances.retry(changes, err)
+		} else {
+			balances.Lock()
+			balances.retryDelay = 0
+			balances.Unlock()
+		}
+	}()
+}
+
+// takeLocked stops the timer and returns up to steveBalancesLimit queued changes,
+// the rest is sent after the next window, balances has to be locked
+func (balances *SteveBalances) takeLocked() []SteveBalanceChange {
+	if balances.timer != nil {
+		balances.timer.Stop()
+		balances.timer = nil
+	}
+
+	var changes []SteveBalanceChange
+	for username, change := range balances.changes {
+		if len(changes) == steveBalancesLimit {
+			break
+		}
+		changes = append(changes, *change)
+		delete(balances.changes, username)
+	}
+
+	if len(balances.changes) > 0 {
+		balances.timer = time.AfterFunc(steveBalancesWindow, balances.flush)
+	}
+
+	return changes
+}
+
+// send posts the changes to steve, changes which steve skipped are logged and not retried
+func (balances *SteveBalances) send(changes []SteveBalanceChange) error {
+	var results []SteveBalanceChangeResult
+	err := steveRequest(http.MethodPost, "/users/balances", changes, &results)
+	if err == errSteveBadRequest {
+		// retrying would fail again
+		log.Errorf("Balances request: %s, lost changes: %+v", err, changes)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for i, result := range results {
+		if result.Error != "" && i < len(changes) {
+			log.Errorf("Balances request: skipped change %+v: %s", changes[i], result.Error)
+		}
+	}
+
+	return nil
+}
+
+// retry queues the failed changes again and sends them after the backoff delay
+func (balances *SteveBalances) retry(changes []SteveBalanceChange, err error) {
+	balances.Lock()
+	defer balances.Unlock()
+
+	for _, change := range changes {
+		balances.merge(change)
+	}
+
+	balances.retryDelay *= 2
+	if balances.retryDelay == 0 {
+		balances.retryDelay = steveBalancesWindow
+	} else if balances.retryDelay > steveBalancesMaxRetryDelay {
+		balances.retryDelay = steveBalancesMaxRetryDelay
+	}
+	log.Error("Balances request: ", err, ", retrying ", len(balances.changes), " changes in ", balances.retryDelay)
+
+	if balances.timer != nil {
+		balances.timer.Stop()
+	}
+	balances.timer = time.AfterFunc(balances.retryDelay, balances.flush)
+}
+
+// close sends the queued changes before ciru exits
+func (balances *SteveBalances) close() {
+	for {
+		balances.Lock()
+		changes := balances.takeLocked()
+		if balances.timer != nil {
+			balances.timer.Stop()
+			balances.timer = nil
+		}
+		balances.Unlock()
+
+		if len(changes) == 0 {
+			return
+		}
+
+		if err := balances.send(changes); err != nil {
+			log.Errorf("Balances request: %s, lost changes: %+v", err, changes)
+		}
+	}
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"context"
+	"errors"
 	"net/http"
 	"os"
 	"strings"
@@ -12,66 +12,184 @@ import (
 	"golang.org/x/oauth2"
 )
 
+const (
+	// How long the subscription summary is served from cache
+	subscriptionsCacheTTL = 5 * time.Minute
+
+	// Time to wait after a sub event before asking the api for the new subscription summary
+	subscriptionsRefreshDelay = 10 * time.Second
+
+	// Time a user has to finish the Twitch login
+	oauthStateTTL = 10 * time.Minute
+
+	// How often a token refresh is tried if Twitch is not reachable
+	tokenRefreshAttempts = 3
+
+	// Stream lifecycle events
+	streamOnline  = "stream:online"
+	streamOffline = "stream:offline"
+	streamUpdate  = "stream:update"
+)
+
+var (
+	errTokenInvalid = errors.New("oauth token is invalid")
+	errNoToken      = errors.New("no oauth token available, login required")
+	errUserNotFound = errors.New("user not found")
+)
+
+// subscriptionTierPoints are the sub points of each tier
+var subscriptionTierPoints = map[string]int{
+	"1000": 1,
+	"2000": 2,
+	"3000": 6,
+}
+
 func newTwitch() *Twitch {
 	log.Info("Init Twitch")
 	twitch := &Twitch{
-		oauthToken: &oauth2.Token{},
+		oauthStates: make(map[string]*TwitchOAuthState),
 		oauthConfig: &oauth2.Config{
 			ClientID:     os.Getenv("TWITCH_CLIENTID"),
 			ClientSecret: os.Getenv("TWITCH_CLIENTSECRET"),
-			Scopes:       []string{"channel:read:redemptions", "channel_subscriptions", "bits:read", "channel:read:subscriptions"},
+			Scopes:       []string{"channel:read:redemptions", "channel_subscriptions", "bits:read", "channel:read:subscriptions", "channel:read:polls", "channel:read:predictions", "channel:read:hype_train", "moderator:manage:banned_users", "moderator:manage:chat_messages", "moderator:manage:chat_settings", "moderator:manage:announcements", "channel:moderate"},
 			RedirectURL:  strings.TrimRight(os.Getenv("BASE_URL"), "/") + "/return",
 			Endpoint: oauth2.Endpoint{
 				AuthURL:  "https://id.twitch.tv/oauth2/authorize",
 				TokenURL: "https://id.twitch.tv/oauth2/token",
+				// Twitch expects the client credentials in the request body
+				AuthStyle: oauth2.AuthStyleInParams,
 			},
 		},
 	}
 
 	twitch.Init()
-	twitch.pubSub = newTwitchPubSub()
+
+	for _, channel := range twitch.channels {
+		token, err := channel.loadOAuthToken()
+		if err != nil {
+			log.Error("Could not load oauth token for ", channel.name, ": ", err)
+		} else if token != nil {
+			log.Info("Loaded oauth token for ", channel.name, " from ", channel.tokenFile())
+			channel.tokenSource.set(token)
+		}
+
+		channel.pubSub = newTwitchPubSub(channel)
+	}
 	twitch.automaticMessages = newAutomaticMessages()
 
+	twitch.eventSub = newTwitchEventSub(twitch.httpClient, twitch.oauthConfig)
+	twitch.eventSub.on("channel.follow", twitch.eventFollow)
+	twitch.eventSub.on("channel.raid", twitch.eventRaid)
+	for _, stage := range []string{"begin", "progress", "end"} {
+		twitch.eventSub.on("channel.poll."+stage, twitch.eventPoll(stage))
+	}
+	for _, stage := range []string{"begin", "progress", "lock", "end"} {
+		twitch.eventSub.on("channel.prediction."+stage, twitch.eventPrediction(stage))
+	}
+	for _, stage := range []string{"begin", "progress", "end"} {
+		twitch.eventSub.on("channel.hype_train."+stage, twitch.eventHypeTrain(stage))
+	}
+	cron.New("eventsub_subscriptions", twitch.eventSub.syncSubscriptions, time.Hour)
+	cron.New("eventsub_message_ids", twitch.eventSub.cleanMessageIDs, eventSubMaxMessageAge)
+	twitch.onStreamEvent(twitch.automaticMessages.streamEvent)
+	twitch.onStreamEvent(twitch.resetFirstChatter)
+
 	return twitch
 }
 
+// start runs the first checks after the global twitch is set, the stream hooks
+// and the EventSub subscriptions use it
+func (twitch *Twitch) start() {
+	go twitch.eventSub.syncSubscriptions()
+	// a stream which is already live when ciru starts goes online here
+	twitch.checkIfOnline()
+}
+
 func (twitch *Twitch) Init() {
 	twitch.RWMutex = &sync.RWMutex{}
 	twitch.httpClient = &http.Client{
 		Timeout: 3 * time.Second,
 	}
-	twitch.oAuthHTTPClient = twitch.oauthConfig.Client(context.Background(), twitch.oauthToken)
-	twitch.oAuthHTTPClient.Timeout = 3 * time.Second
-	twitch.users = make(map[string]*TwitchUserDetails)
-
-	options := twirgo.Options{
-		Username:       os.Getenv("TWITCH_USERNAME"),
-		Token:          os.Getenv("TWITCH_TOKEN"),
-		Channels:       []string{strings.ToLower(os.Getenv("TWITCH_CHANNEL"))},
-		Log:            log,
-		DefaultChannel: os.Getenv("TWITCH_CHANNEL"),
-	}
+	twitch.users = newCache("twitch_users", envInt("TWITCH_USER_CACHE_SIZE", 10000), 15*time.Minute, time.Minute, func(err error) bool {
+		return err == errUserNotFound
+	})
+	// the badges are refreshed by crons, failed requests are retried after 5 minutes
+	twitch.badges = newCache("twitch_badges", 0, 48*time.Hour, 5*time.Minute, func(err error) bool {
+		return true
+	})
+	// failed requests are retried after 5 minutes
+	twitch.cheermotes = newCache("twitch_cheermotes", 0, 24*time.Hour, 5*time.Minute, func(err error) bool {
+		return true
+	})
+	twitch.emoteProviders = newTwitchEmoteProviders(twitch.httpClient)
+	// the emotes are refreshed by a cron, failed requests are retried after 5 minutes
+	twitch.emotes = newCache("third_party_emotes", 0, 3*envDuration("EMOTE_PROVIDERS_INTERVAL", 30*time.Minute), 5*time.Minute, func(err error) bool {
+		return true
+	})
+	twitch.channels = make(map[string]*TwitchChannel)
+	twitch.moderation = newTwitchModeration()
+	twitch.enrichment = newTwitchEnrichment(twitch.enrichMessage)
+	twitch.chatLog = newTwitchChatLog()
+	twitch.chatQueue = newTwitchChatQueue(func(channel string, message string) {
+		twitch.twirgo.SendMessage(channel, message)
+	})
 
 	twitch.clientID = os.Getenv("TWITCH_CLIENTID")
 	if twitch.clientID == "" {
 		log.Fatal("Env var TWITCH_CLIENTID is not set")
 	}
 
-	user, err := twitch.getUser(options.DefaultChannel)
-	if err != nil {
-		log.Error(err)
-		log.Fatal("Could not get user information from Twitch")
+	// TWITCH_CHANNEL is still supported for setups with a single channel
+	channelNames := os.Getenv("TWITCH_CHANNELS")
+	if channelNames == "" {
+		channelNames = os.Getenv("TWITCH_CHANNEL")
+	}
+
+	for _, name := range strings.Split(channelNames, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		user, err := twitch.getUser(name)
+		if err != nil {
+			log.Error(err)
+			log.Fatal("Could not get user information from Twitch for channel ", name)
+		}
+
+		twitch.channels[name] = newTwitchChannel(name, user.ID, twitch.httpClient, twitch.oauthConfig)
+		twitch.channelNames = append(twitch.channelNames, name)
 	}
 
-	twitch.channelID = user.ID
+	if len(twitch.channelNames) == 0 {
+		log.Fatal("Env var TWITCH_CHANNELS is not set")
+	}
+
+	options := twirgo.Options{
+		Username:       os.Getenv("TWITCH_USERNAME"),
+		Token:          os.Getenv("TWITCH_TOKEN"),
+		Channels:       twitch.channelNames,
+		Log:            log,
+		DefaultChannel: twitch.channelNames[0],
+	}
 
 	twitch.fetchChannelBadges()
 	twitch.fetchGlobalBadges()
-	twitch.checkIfOnline()
 	cron.New("channel_badges", twitch.fetchChannelBadges, 24*time.Hour)
 	cron.New("global_badges", twitch.fetchGlobalBadges, 24*time.Hour)
-	cron.New("check_if_online", twitch.checkIfOnline, 15*time.Minute)
-	cron.New("clean_users", twitch.cleanUsers, 15*time.Minute)
+	go twitch.loadThirdPartyEmotes()
+	cron.New("third_party_emotes", twitch.loadThirdPartyEmotes, envDuration("EMOTE_PROVIDERS_INTERVAL", 30*time.Minute))
+	// the online check also samples the viewer count of the stream sessions
+	cron.New("check_if_online", twitch.checkIfOnline, envDuration("STREAM_CHECK_INTERVAL", 5*time.Minute))
+	cron.New("clean_caches", cleanCaches, 15*time.Minute)
+	cron.New("known_chatters", twitch.cleanKnownChatters, time.Hour)
+	for _, channel := range twitch.channels {
+		go twitch.loadKnownChatters(channel)
+	}
+	cron.New("moderation_config", twitch.moderation.loadConfig, 5*time.Minute)
+	cron.New("moderation_recent_messages", twitch.moderation.cleanRecentMessages, 15*time.Minute)
+	// Twitch requires apps to validate their tokens every hour
+	cron.New("validate_oauth_token", twitch.validateAccessTokens, time.Hour)
 
 	// initiate TWIRGO
 
@@ -85,6 +203,7 @@ func (twitch *Twitch) Init() {
 	twitch.twirgo.OnMessageReceived(twitch.eventMessageReceived)
 	twitch.twirgo.OnClearchat(twitch.eventClearchat)
 	twitch.twirgo.OnClearmsg(twitch.eventClearmsg)
+	twitch.twirgo.OnUsernotice(twitch.eventUsernotice)
 
 	go twitch.twirgo.Run(ch)
 }
@@ -92,23 +211,12 @@ func (twitch *Twitch) Init() {
 func (twitch *Twitch) getUser(username string) (*TwitchUserDetails, error) {
 	username = strings.ToLower(strings.TrimSpace(username))
 
-	if user, ok := twitch.users[username]; ok {
-		return user, nil
+	user, err := twitch.users.get(username, func() (interface{}, error) {
+		return twitch.fetchUser(username)
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return twitch.fetchUser(username)
-}
-
-func (twitch *Twitch) cleanUsers() {
-	twitch.RLock()
-	users := twitch.users
-	twitch.RUnlock()
-
-	for username := range users {
-		if time.Now().After(twitch.users[username].fetchedTimestamp.Add(15 * time.Minute)) {
-			twitch.Lock()
-			delete(users, username)
-			twitch.Unlock()
-		}
-	}
+	return user.(*TwitchUserDetails), nil
 }
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// IRC and EventSub report the same raid a few seconds apart
+const raidDedupeWindow = 10 * time.Minute
+
+func (twitch *Twitch) eventFollow(channel *TwitchChannel, event json.RawMessage) {
+	var e struct {
+		UserID     string    `json:"user_id"`
+		UserLogin  string    `json:"user_login"`
+		UserName   string    `json:"user_name"`
+		FollowedAt time.Time `json:"followed_at"`
+	}
+	err := json.Unmarshal(event, &e)
+	if err != nil {
+		log.Error("Follow: could not unmarshal event: ", err)
+		return
+	}
+
+	follow := TwitchFollow{
+		UserID:      e.UserID,
+		Username:    e.UserLogin,
+		DisplayName: e.UserName,
+		FollowedAt:  e.FollowedAt,
+	}
+
+	// follows of a flood are recorded without reward so that
+	// the accounts are not rewarded if they follow again later
+	flood := twitch.trackFollow(channel)
+	taler, reputationPoints := envInt("FOLLOW_TALER", 0), envInt("FOLLOW_REPUTATION_POINTS", 0)
+	if flood {
+		taler, reputationPoints = 0, 0
+	}
+
+	var res struct {
+		FirstTime bool `json:"firstTime"`
+	}
+	err = steveRequest(http.MethodPost, "/follow", map[string]interface{}{
+		"channel":          channel.name,
+		"userID":           follow.UserID,
+		"username":         follow.Username,
+		"followedAt":       follow.FollowedAt,
+		"taler":            taler,
+		"reputationPoints": reputationPoints,
+	}, &res)
+	if err != nil {
+		log.Error("Follow: could not record follow: ", err)
+	}
+	follow.FirstTime = res.FirstTime
+
+	if flood {
+		log.Debug("Follow: ", e.UserLogin, " is part of a follow flood in ", channel.name)
+		return
+	}
+
+	if user, err := twitch.getUser(follow.Username); err != nil {
+		log.Error("Follow: ", err)
+	} else {
+		follow.LogoURL = user.LogoURL
+	}
+
+	hugo.hub.broadcast(channel.name, follow)
+}
+
+// trackFollow returns true if the follow is part of a follow flood.
+// Those follows are recorded without reward and not broadcasted but collapsed
+// into one follow:burst event when the flood is over.
+func (twitch *Twitch) trackFollow(channel *TwitchChannel) bool {
+	threshold := envInt("FOLLOW_FLOOD_THRESHOLD", 10)
+	window := envDuration("FOLLOW_FLOOD_WINDOW", 30*time.Second)
+
+	channel.Lock()
+	defer channel.Unlock()
+
+	now := time.Now()
+	recentFollows := channel.recentFollows[:0]
+	for _, followedAt := range channel.recentFollows {
+		if now.Sub(followedAt) < window {
+			recentFollows = append(recentFollows, followedAt)
+		}
+	}
+	channel.recentFollows = append(recentFollows, now)
+
+	if channel.followBurst == nil {
+		if len(channel.recentFollows) < threshold {
+			return false
+		}
+
+		// the follows before the threshold was reached are already broadcasted
+		// but still belong to the burst
+		channel.followBurst = &TwitchFollowBurst{
+			Count:     len(channel.recentFollows) - 1,
+			StartedAt: channel.recentFollows[0],
+		}
+		channel.followBurstTimer = time.AfterFunc(window, func() {
+			twitch.endFollowBurst(channel)
+		})
+	} else {
+		channel.followBurstTimer.Reset(window)
+	}
+
+	channel.followBurst.Count++
+
+	return true
+}
+
+func (twitch *Twitch) endFollowBurst(channel *TwitchChannel) {
+	channel.Lock()
+	burst := channel.followBurst
+	channel.followBurst = nil
+	channel.recentFollows = nil
+	channel.Unlock()
+
+	if burst == nil {
+		return
+	}
+
+	burst.EndedAt = time.Now()
+	log.Info("Follow: flood of ", burst.Count, " follows in ", channel.name, " is over")
+	hugo.hub.broadcast(channel.name, *burst)
+}
+
+func (twitch *Twitch) eventRaid(channel *TwitchChannel, event json.RawMessage) {
+	var e struct {
+		FromBroadcasterUserID    string `json:"from_broadcaster_user_id"`
+		FromBroadcasterUserLogin string `json:"from_broadcaster_user_login"`
+		FromBroadcasterUserName  string `json:"from_broadcaster_user_name"`
+		Viewers                  int    `json:"viewers"`
+	}
+	err := json.Unmarshal(event, &e)
+	if err != nil {
+		log.Error("Raid: could not unmarshal event: ", err)
+		return
+	}
+
+	twitch.raid(channel, TwitchRaid{
+		UserID:      e.FromBroadcasterUserID,
+		Username:    e.FromBroadcasterUserLogin,
+		DisplayName: e.FromBroadcasterUserName,
+		Viewers:     e.Viewers,
+	})
+}
+
+// raid records and broadcasts the raid once, IRC and EventSub both report it
+func (twitch *Twitch) raid(channel *TwitchChannel, raid TwitchRaid) {
+	if !twitch.trackRaid(channel, raid.UserID) {
+		log.Debug("Raid: ignoring duplicate raid of ", raid.Username, " in ", channel.name)
+		return
+	}
+
+	if user, err := twitch.getUser(raid.Username); err != nil {
+		log.Error("Raid: ", err)
+	} else {
+		raid.LogoURL = user.LogoURL
+	}
+
+	log.Info("Raid: ", raid.Username, " raids ", channel.name, " with ", raid.Viewers, " viewers")
+
+	err := steveRequest(http.MethodPost, "/raid", map[string]interface{}{
+		"channel":          channel.name,
+		"fromUserID":       raid.UserID,
+		"fromUsername":     raid.Username,
+		"viewers":          raid.Viewers,
+		"taler":            envInt("RAID_TALER", 0),
+		"reputationPoints": envInt("RAID_REPUTATION_POINTS", 0) + raid.Viewers*envInt("RAID_REPUTATION_POINTS_PER_VIEWER", 0),
+	}, nil)
+	if err != nil {
+		log.Error("Raid: could not record raid: ", err)
+	}
+
+	hugo.hub.broadcast(channel.name, raid)
+}
+
+// trackRaid returns false if the raid of the user was already handled within raidDedupeWindow
+func (twitch *Twitch) trackRaid(channel *TwitchChannel, userID string) bool {
+	channel.Lock()
+	defer channel.Unlock()
+
+	now := time.Now()
+	for id, raidedAt := range channel.recentRaids {
+		if now.Sub(raidedAt) >= raidDedupeWindow {
+			delete(channel.recentRaids, id)
+		}
+	}
+
+	if _, ok := channel.recentRaids[userID]; ok {
+		return false
+	}
+	channel.recentRaids[userID] = now
+
+	return true
+}
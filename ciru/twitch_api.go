@@ -6,11 +6,9 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
-	"os"
-	"strings"
+	"net/url"
+	"strconv"
 	"time"
-
-	"golang.org/x/oauth2"
 )
 
 func (twitch *Twitch) fetchUser(username string) (*TwitchUserDetails, error) {
@@ -29,15 +27,11 @@ func (twitch *Twitch) fetchUser(username string) (*TwitchUserDetails, error) {
 
 	for _, user := range respJSON.Users {
 		if username == user.Username {
-			user.fetchedTimestamp = time.Now()
-			twitch.Lock()
-			twitch.users[user.Username] = user
-			twitch.Unlock()
 			return user, nil
 		}
 	}
 
-	return nil, errors.New("User not found")
+	return nil, errUserNotFound
 }
 
 func (twitch *Twitch) apiRequest(httpClient *http.Client, method string, url string, body io.Reader, v5 bool) ([]byte, error) {
@@ -46,12 +40,12 @@ func (twitch *Twitch) apiRequest(httpClient *http.Client, method string, url str
 		return nil, err
 	}
 
-	// it works for this cases but normally you would not send your accesstoken every time
-	// if you do not query the v5 api
+	// helix requests are authorized by the oauth http client
 	if v5 {
 		req.Header.Add("Accept", "application/vnd.twitchtv.v5+json")
-	} else {
-		req.Header.Add("Authorization", "Bearer "+twitch.oauthToken.AccessToken)
+	}
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
 	}
 	req.Header.Add("Client-ID", twitch.clientID)
 
@@ -59,92 +53,149 @@ func (twitch *Twitch) apiRequest(httpClient *http.Client, method string, url str
 	if err != nil {
 		return nil, err
 	}
+	defer res.Body.Close()
 
 	resBody, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		return nil, err
 	}
 
-	log.Debugf("API Request %s %s: %s", method, url, body)
+	log.Debugf("API Request %s %s: %d %s", method, url, res.StatusCode, resBody)
+
+	// error responses would unmarshal into empty results
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		var resErr struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(resBody, &resErr) == nil && resErr.Message != "" {
+			return resBody, errors.New("twitch: got " + res.Status + " as response: " + resErr.Message)
+		}
+		return resBody, errors.New("twitch: got " + res.Status + " as response")
+	}
 
 	return resBody, nil
 }
 
 func (twitch *Twitch) fetchChannelBadges() {
-	res, err := http.Get("https://badges.twitch.tv/v1/badges/channels/" + twitch.channelID + "/display")
+	for _, channel := range twitch.channels {
+		badges, err := twitch.requestChannelBadges(channel)
+		if err != nil {
+			log.Error("Channel badges: ", err)
+			continue
+		}
+
+		twitch.badges.set("channel:"+channel.id, badges)
+	}
+}
+
+func (twitch *Twitch) requestChannelBadges(channel *TwitchChannel) (map[string]map[string]*TwitchBadge, error) {
+	res, err := twitch.httpClient.Get("https://badges.twitch.tv/v1/badges/channels/" + channel.id + "/display")
 	if err != nil {
-		log.Error("Could not get badges from Twitch: ", err)
-		return
+		return nil, err
 	}
+	defer res.Body.Close()
 
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		log.Error("Channel badges: ", err)
-		return
+		return nil, err
 	}
 
 	log.Debugf("fetchChannelBadges: %s", body)
 
-	var respJSON struct {
-		BadgeSets struct {
-			Bits struct {
-				Versions map[int64]*TwitchBadge `json:"versions"`
-			} `json:"bits"`
-			Subscriber struct {
-				Versions map[int64]*TwitchBadge `json:"versions"`
-			} `json:"subscriber"`
-		} `json:"badge_sets"`
-	}
+	return parseBadgeSets(body)
+}
 
-	err = json.Unmarshal(body, &respJSON)
+func (twitch *Twitch) fetchGlobalBadges() {
+	badges, err := twitch.requestGlobalBadges()
 	if err != nil {
-		log.Error("Channel badges: ", err)
+		log.Error("Global badges: ", err)
 		return
 	}
 
-	twitch.Lock()
-	defer twitch.Unlock()
-	twitch.bitsBadges = respJSON.BadgeSets.Bits.Versions
-	twitch.subscriberBadges = respJSON.BadgeSets.Subscriber.Versions
+	twitch.badges.set("global", badges)
 }
 
-func (twitch *Twitch) fetchGlobalBadges() {
-	res, err := http.Get("https://badges.twitch.tv/v1/badges/global/display")
+func (twitch *Twitch) requestGlobalBadges() (map[string]map[string]*TwitchBadge, error) {
+	res, err := twitch.httpClient.Get("https://badges.twitch.tv/v1/badges/global/display")
 	if err != nil {
-		log.Error("Could not get global badges from Twitch: ", err)
-		return
+		return nil, err
 	}
+	defer res.Body.Close()
 
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		log.Error("Global badges: ", err)
-		return
+		return nil, err
 	}
 
 	log.Debugf("fetchGlobalBadges: %s", body)
 
-	var badges struct {
+	return parseBadgeSets(body)
+}
+
+// parseBadgeSets returns the badges of the response by set and version
+func parseBadgeSets(body []byte) (map[string]map[string]*TwitchBadge, error) {
+	var respJSON struct {
 		BadgeSets map[string]struct {
 			Versions map[string]*TwitchBadge `json:"versions"`
 		} `json:"badge_sets"`
 	}
 
-	err = json.Unmarshal(body, &badges)
+	err := json.Unmarshal(body, &respJSON)
 	if err != nil {
-		log.Error("Global badges: ", err)
-		return
+		return nil, err
+	}
+
+	badges := make(map[string]map[string]*TwitchBadge)
+	for set, b := range respJSON.BadgeSets {
+		badges[set] = b.Versions
 	}
 
-	twitch.Lock()
-	twitch.globalBadges = make(map[string]map[string]*TwitchBadge)
-	for name, b := range badges.BadgeSets {
-		twitch.globalBadges[name] = b.Versions
+	return badges, nil
+}
+
+// channelBadges returns the cached badges of the channel by set and version, e.g. bits and subscriber.
+// It is called for every chat message and never waits for Twitch, the badges are empty until
+// they are fetched in the background or by the channel_badges cron.
+func (twitch *Twitch) channelBadges(channel *TwitchChannel) map[string]map[string]*TwitchBadge {
+	badges, ok := twitch.badges.cached("channel:"+channel.id, func() (interface{}, error) {
+		badges, err := twitch.requestChannelBadges(channel)
+		if err != nil {
+			log.Error("Channel badges: ", err)
+		}
+		return badges, err
+	})
+	if !ok {
+		return make(map[string]map[string]*TwitchBadge)
 	}
-	defer twitch.Unlock()
+
+	return badges.(map[string]map[string]*TwitchBadge)
+}
+
+// globalBadges returns the cached global badges by name and version, they are empty until
+// they are fetched in the background or by the global_badges cron
+func (twitch *Twitch) globalBadges() map[string]map[string]*TwitchBadge {
+	badges, ok := twitch.badges.cached("global", func() (interface{}, error) {
+		badges, err := twitch.requestGlobalBadges()
+		if err != nil {
+			log.Error("Global badges: ", err)
+		}
+		return badges, err
+	})
+	if !ok {
+		return make(map[string]map[string]*TwitchBadge)
+	}
+
+	return badges.(map[string]map[string]*TwitchBadge)
 }
 
 func (twitch *Twitch) checkIfOnline() {
-	body, err := twitch.apiRequest(twitch.httpClient, http.MethodGet, "https://api.twitch.tv/kraken/streams/"+twitch.channelID, nil, true)
+	for _, channel := range twitch.channels {
+		twitch.checkChannelOnline(channel)
+	}
+}
+
+func (twitch *Twitch) checkChannelOnline(channel *TwitchChannel) {
+	body, err := twitch.apiRequest(twitch.httpClient, http.MethodGet, "https://api.twitch.tv/kraken/streams/"+channel.id, nil, true)
 	if err != nil {
 		log.Error("Check if online: ", err)
 		return
@@ -196,84 +247,130 @@ func (twitch *Twitch) checkIfOnline() {
 		return
 	}
 
-	if res.Stream.ID > 0 {
-		twitch.isOnline = true
-	} else {
-		twitch.isOnline = false
+	if res.Stream.ID == 0 {
+		twitch.updateStream(channel, nil)
+		return
 	}
-}
 
-func (twitch *Twitch) refreshAccessToken() {
-	log.Info("Refreshing access token")
-	tokenURL := "https://id.twitch.tv/oauth2/token"
-	bodyString := "grant_type=refresh_token&refresh_token=" + twitch.oauthToken.RefreshToken + "&client_id=" + os.Getenv("TWITCH_CLIENTID") + "&client_secret=" + os.Getenv("TWITCH_CLIENTSECRET")
-	body := strings.NewReader(bodyString)
-	log.Debug("Sending Twitch API request to ", tokenURL, " with: ", bodyString)
+	twitch.updateStream(channel, &TwitchStream{
+		ID:        strconv.FormatInt(res.Stream.ID, 10),
+		Title:     res.Stream.Channel.Status,
+		Game:      res.Stream.Game,
+		Viewers:   res.Stream.Viewers,
+		StartedAt: res.Stream.CreatedAt,
+	})
+}
 
-	r, err := http.Post(tokenURL, "", body)
-	if err != nil {
-		log.Error("Could not refresh auth token: ", err)
-		twitch.Lock()
-		twitch.oauthToken = &oauth2.Token{}
-		twitch.Unlock()
-		return
+func (twitch *Twitch) getBroadcasterSubscriptions(channel *TwitchChannel) (*TwitchSubscriptions, error) {
+	subscriptions := &TwitchSubscriptions{
+		Tiers: make(map[string]int),
 	}
 
-	var token oauth2.Token
+	var cursor string
+	// empty if the broadcaster is not in the list
+	var broadcasterTier string
+	for {
+		requestURL := "https://api.twitch.tv/helix/subscriptions?first=100&broadcaster_id=" + channel.id
+		if cursor != "" {
+			requestURL += "&after=" + url.QueryEscape(cursor)
+		}
 
-	rBody, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		log.Error("Can not read Twitch response for token refresh: ", err)
-		twitch.Lock()
-		twitch.oauthToken = &oauth2.Token{}
-		twitch.Unlock()
-		return
-	}
+		body, err := twitch.apiRequest(channel.oAuthHTTPClient, http.MethodGet, requestURL, nil, false)
+		if err != nil {
+			log.Error("Broadcaster subscriptions: ", err)
+			return nil, err
+		}
 
-	log.Debugf("Received response for access token refresh: %s", rBody)
+		log.Debugf("Broadcaster subscriptions: %s", body)
+
+		var res struct {
+			Data []struct {
+				BroadcasterID   string `json:"broadcaster_id"`
+				BroadcasterName string `json:"broadcaster_name"`
+				GifterID        string `json:"gifter_id"`
+				IsGift          bool   `json:"is_gift"`
+				Tier            string `json:"tier"`
+				PlanName        string `json:"plan_name"`
+				UserID          string `json:"user_id"`
+				Username        string `json:"user_name"`
+			} `json:"data"`
+			Pagination struct {
+				Cursor string `json:"cursor"`
+			} `json:"pagination"`
+			Total  int `json:"total"`
+			Points int `json:"points"`
+		}
 
-	err = json.Unmarshal(rBody, &token)
-	if err != nil {
-		log.Error("Can not unmarshal Twitch response for token refresh: ", err)
-		twitch.Lock()
-		twitch.oauthToken = &oauth2.Token{}
-		twitch.Unlock()
-		return
-	}
+		err = json.Unmarshal(body, &res)
+		if err != nil {
+			log.Error("Broadcaster subscriptions unmarshal: ", err)
+			return nil, err
+		}
 
-	twitch.Lock()
-	log.Debug("Set new access and refresh token: ", token.AccessToken, " - ", token.RefreshToken)
-	twitch.oauthToken = &token
-	twitch.Unlock()
-}
+		// total and points are the same on every page and already
+		// include the subscriptions we have not read yet
+		subscriptions.Total = res.Total
+		subscriptions.Points = res.Points
+
+		for _, sub := range res.Data {
+			// the broadcaster is always subscribed to their own channel
+			// but does not count towards the sub goal
+			if sub.UserID == channel.id {
+				broadcasterTier = sub.Tier
+				continue
+			}
+
+			subscriptions.Tiers[sub.Tier]++
+			if sub.IsGift {
+				subscriptions.Gifted++
+			} else {
+				subscriptions.Paid++
+			}
+		}
 
-func (twitch *Twitch) getBroadcasterSubscriptions() (int, error) {
-	body, err := twitch.apiRequest(twitch.httpClient, http.MethodGet, "https://api.twitch.tv/helix/subscriptions?broadcaster_id="+twitch.channelID, nil, false)
-	if err != nil {
-		log.Error("Broadcaster subscriptions: ", err)
-		return 0, err
+		if res.Pagination.Cursor == "" || len(res.Data) == 0 {
+			break
+		}
+		cursor = res.Pagination.Cursor
 	}
 
-	log.Debugf("Broadcaster subscriptions: %s", body)
+	// total and points of Twitch include the sub of the broadcaster,
+	// it is removed so that they match tiers, gifted and paid
+	if broadcasterTier != "" {
+		subscriptions.Total--
+		subscriptions.Points -= subscriptionTierPoints[broadcasterTier]
+	}
 
-	var res struct {
-		Data []struct {
-			BroadcasterID   string `json:"broadcaster_id"`
-			BroadcasterName string `json:"broadcaster_name"`
-			IsGift          bool   `json:"is_gift"`
-			Tier            string `json:"tier"`
-			PlanName        string `json:"plan_name"`
-			UserID          string `json:"user_id"`
-			Username        string `json:"user_name"`
-		} `json:"data"`
+	subscriptions.UpdatedAt = time.Now()
+
+	return subscriptions, nil
+}
+
+// getSubscriptions returns the cached subscription summary and only asks Twitch
+// again if the cache is older than subscriptionsCacheTTL
+func (twitch *Twitch) getSubscriptions(channel *TwitchChannel) (*TwitchSubscriptions, error) {
+	channel.RLock()
+	subscriptions := channel.subscriptions
+	channel.RUnlock()
+
+	if subscriptions != nil && time.Now().Before(subscriptions.UpdatedAt.Add(subscriptionsCacheTTL)) {
+		return subscriptions, nil
 	}
 
-	err = json.Unmarshal(body, &res)
+	return twitch.refreshSubscriptions(channel)
+}
+
+func (twitch *Twitch) refreshSubscriptions(channel *TwitchChannel) (*TwitchSubscriptions, error) {
+	subscriptions, err := twitch.getBroadcasterSubscriptions(channel)
 	if err != nil {
-		log.Error("Broadcaster subscriptions unmarshal: ", err)
-		return 0, err
+		return nil, err
 	}
 
-	// not completely implemented because Twitch does not deliver any endpoint with just the subcount
-	return 0, nil
+	channel.Lock()
+	channel.subscriptions = subscriptions
+	channel.Unlock()
+
+	hugo.hub.broadcast(channel.name, *subscriptions)
+
+	return subscriptions, nil
 }
@@ -77,9 +77,10 @@ func (automaticMessages *TwitchAutomaticMessages) scheduler() {
 						}
 					}
 
-					if twitch.isOnline {
+					// automatic messages are only sent to the default channel
+					if channel := twitch.defaultChannel(); channel.online() {
 						log.Info("Automatic messages sending message ", message.ID)
-						twitch.twirgo.SendMessage(twitch.twirgo.Options().DefaultChannel, message.Content)
+						twitch.say(channel, message.Content, chatPriorityAutomatic)
 					}
 					automaticMessages.Lock()
 					automaticMessages.scheduledMessages[id] = time.Now().Add(time.Duration(message.Interval) * time.Minute)
@@ -90,6 +91,20 @@ func (automaticMessages *TwitchAutomaticMessages) scheduler() {
 	}
 }
 
+// streamEvent restarts the intervals of all messages when the default channel goes online
+// so that no message is sent right at the start of the stream
+func (automaticMessages *TwitchAutomaticMessages) streamEvent(channel *TwitchChannel, event string, stream TwitchStream) {
+	if event != streamOnline || channel != twitch.defaultChannel() {
+		return
+	}
+
+	log.Info("Automatic messages restarting schedule for new stream")
+	automaticMessages.Lock()
+	automaticMessages.scheduledMessages = make(map[int]time.Time)
+	automaticMessages.Unlock()
+	automaticMessages.scheduleMessages()
+}
+
 func (automaticMessages *TwitchAutomaticMessages) scheduleMessages() {
 	log.Info("Automatic messages rescheduling all messages")
 	automaticMessages.Lock()
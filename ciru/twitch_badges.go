@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sort"
+)
+
+// badgePriority is the display order of the badge sets, all other sets follow in alphabetical order
+var badgePriority = []string{"broadcaster", "staff", "admin", "global_mod", "moderator", "vip", "founder", "subscriber", "sub-gifter", "bits", "bits-leader"}
+
+// resolveBadges returns the badges of the user in display order, badges of the channel are preferred
+// over global badges with the same set and version. Unknown badges are skipped.
+func (twitch *Twitch) resolveBadges(channel *TwitchChannel, badges map[string]string) []*TwitchResolvedBadge {
+	var channelBadges map[string]map[string]*TwitchBadge
+	if channel != nil {
+		channelBadges = twitch.channelBadges(channel)
+	}
+	globalBadges := twitch.globalBadges()
+
+	resolved := []*TwitchResolvedBadge{}
+	for set, version := range badges {
+		badge := channelBadges[set][version]
+		if badge == nil {
+			badge = globalBadges[set][version]
+		}
+		if badge == nil {
+			log.Debug("Unknown badge ", set, "/", version)
+			continue
+		}
+
+		resolved = append(resolved, &TwitchResolvedBadge{
+			Set:     set,
+			Version: version,
+			Title:   badge.Title,
+			URLs: TwitchImageURLs{
+				X1: badge.ImageURL1x,
+				X2: badge.ImageURL2x,
+				X4: badge.ImageURL,
+			},
+		})
+	}
+
+	sort.Slice(resolved, func(i, j int) bool {
+		rankI, rankJ := badgeRank(resolved[i].Set), badgeRank(resolved[j].Set)
+		if rankI != rankJ {
+			return rankI < rankJ
+		}
+
+		return resolved[i].Set < resolved[j].Set
+	})
+
+	return resolved
+}
+
+func badgeRank(set string) int {
+	for i, s := range badgePriority {
+		if s == set {
+			return i
+		}
+	}
+
+	return len(badgePriority)
+}
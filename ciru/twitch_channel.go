@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func newTwitchChannel(name string, id string, httpClient *http.Client, oauthConfig *oauth2.Config) *TwitchChannel {
+	log.Info("Init channel ", name)
+	channel := &TwitchChannel{
+		RWMutex:       &sync.RWMutex{},
+		name:          name,
+		id:            id,
+		knownChatters: make(map[string]time.Time),
+		recentRaids:   make(map[string]time.Time),
+
+		knownChattersSince: time.Now(),
+
+		moderatorActions:       make(map[string]TwitchModeratorAction),
+		moderatorActionWaiters: make(map[string]chan bool),
+	}
+
+	// token refreshs use the http client with timeout as well
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, httpClient)
+	channel.tokenSource = newTwitchTokenSource(ctx, oauthConfig, func(token *oauth2.Token) {
+		if err := channel.saveOAuthToken(token); err != nil {
+			log.Error("Could not save oauth token for ", channel.name, ": ", err)
+		}
+	})
+	channel.oAuthHTTPClient = oauth2.NewClient(ctx, channel.tokenSource)
+	channel.oAuthHTTPClient.Timeout = 3 * time.Second
+
+	return channel
+}
+
+// channel returns the channel with the given name or nil if ciru does not join it
+func (twitch *Twitch) channel(name string) *TwitchChannel {
+	return twitch.channels[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "#")))]
+}
+
+func (twitch *Twitch) channelByID(id string) *TwitchChannel {
+	for _, channel := range twitch.channels {
+		if channel.id == id {
+			return channel
+		}
+	}
+
+	return nil
+}
+
+// defaultChannel is the first configured channel
+func (twitch *Twitch) defaultChannel() *TwitchChannel {
+	return twitch.channels[twitch.channelNames[0]]
+}
+
+// channelFromRequest returns the channel of the query parameter "channel"
+// or the default channel if the parameter is not set
+func (twitch *Twitch) channelFromRequest(r *http.Request) *TwitchChannel {
+	name := r.URL.Query().Get("channel")
+	if name == "" {
+		return twitch.defaultChannel()
+	}
+
+	return twitch.channel(name)
+}
+
+func (channel *TwitchChannel) online() bool {
+	channel.RLock()
+	defer channel.RUnlock()
+	return channel.stream != nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+func newTwitchChatLog() *TwitchChatLog {
+	chatLog := &TwitchChatLog{
+		requests: make(chan TwitchChatLogRequest, envInt("CHAT_LOG_QUEUE_SIZE", 1000)),
+	}
+	go chatLog.worker()
+
+	return chatLog
+}
+
+// enqueue sends the request in the background, it is dropped if the queue is full
+// because the chat must not wait for the data service
+func (chatLog *TwitchChatLog) enqueue(path string, body map[string]interface{}) {
+	select {
+	case chatLog.requests <- TwitchChatLogRequest{path: path, body: body}:
+	default:
+		log.Warn("Chat log: queue is full, dropped ", path, " request")
+	}
+}
+
+// worker sends the requests in order, a tombstone is stored after the messages it deletes
+func (chatLog *TwitchChatLog) worker() {
+	for r := range chatLog.requests {
+		err := steveRequest(http.MethodPost, r.path, r.body, nil)
+		if err != nil {
+			log.Error("Chat log: ", err)
+		}
+	}
+}
+
+// logChatMessage stores the message in the chat log of the data service
+func (twitch *Twitch) logChatMessage(channel *TwitchChannel, m TwitchMessage) {
+	var command string
+	if m.IsCommand {
+		command = strings.Fields(strings.TrimPrefix(m.Content, "!") + " ")[0]
+	}
+
+	var streamSessionID *int
+	channel.RLock()
+	if channel.stream != nil && channel.stream.SessionID > 0 {
+		id := channel.stream.SessionID
+		streamSessionID = &id
+	}
+	channel.RUnlock()
+
+	twitch.chatLog.enqueue("/chat/messages", map[string]interface{}{
+		"id":              m.ID,
+		"channel":         channel.name,
+		"userID":          m.User.ID,
+		"username":        m.User.Username,
+		"displayName":     m.User.DisplayName,
+		"content":         m.Content,
+		"command":         command,
+		"streamSessionID": streamSessionID,
+		"sentAt":          m.Timestamp,
+	})
+}
+
+// logChatTombstone stores a clearchat (msgID is empty) or clearmsg in the chat log of the data service
+func (twitch *Twitch) logChatTombstone(channelName string, username string, msgID string) {
+	channel := twitch.channel(channelName)
+	if channel == nil {
+		return
+	}
+
+	twitch.chatLog.enqueue("/chat/tombstones", map[string]interface{}{
+		"channel":   channel.name,
+		"username":  username,
+		"messageID": msgID,
+		"clearedAt": time.Now(),
+	})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// lower values are sent first
+	chatPriorityModeration = iota
+	chatPriorityCommand
+	chatPriorityAutomatic
+
+	chatPriorities = 3
+
+	// Twitch drops messages which are longer
+	chatMessageMaxLength = 500
+	// Twitch drops identical messages within this time
+	chatDuplicateWindow = 30 * time.Second
+	// the rate limits are per 30 seconds
+	chatRateWindow = 30 * time.Second
+)
+
+func newTwitchChatQueue(send func(channel string, message string)) *TwitchChatQueue {
+	modChannels := make(map[string]bool)
+	for _, name := range strings.Split(os.Getenv("TWITCH_MOD_CHANNELS"), ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			modChannels[name] = true
+		}
+	}
+	// the bot is always allowed to use the mod limit in its own channel
+	if username := strings.ToLower(os.Getenv("TWITCH_USERNAME")); username != "" {
+		modChannels[username] = true
+	}
+
+	queue := &TwitchChatQueue{
+		Mutex:       &sync.Mutex{},
+		send:        send,
+		wake:        make(chan bool, 1),
+		limit:       envInt("CHAT_RATE_LIMIT", 20),
+		modLimit:    envInt("CHAT_RATE_LIMIT_MOD", 100),
+		laneSize:    envInt("CHAT_QUEUE_SIZE", 100),
+		modChannels: modChannels,
+		channels:    make(map[string]*TwitchChatQueueChannel),
+		now:         time.Now,
+	}
+
+	go queue.sender()
+
+	return queue
+}
+
+// say queues the message for the channel, messages longer than
+// chatMessageMaxLength are split and duplicates within chatDuplicateWindow are dropped, except commands
+func (twitch *Twitch) say(channel *TwitchChannel, message string, priority int) {
+	twitch.chatQueue.enqueue(channel.name, message, priority)
+}
+
+func (queue *TwitchChatQueue) enqueue(channelName string, message string, priority int) {
+	message = strings.TrimSpace(message)
+	if message == "" {
+		return
+	}
+	if priority < 0 || priority >= chatPriorities {
+		priority = chatPriorityAutomatic
+	}
+
+	queue.Lock()
+	channel := queue.channel(channelName)
+
+	now := queue.now()
+	for content, sentAt := range channel.recent {
+		if now.Sub(sentAt) >= chatDuplicateWindow {
+			delete(channel.recent, content)
+		}
+	}
+	// commands like /timeout can be repeated on purpose
+	if _, ok := channel.recent[message]; ok && !isChatCommand(message) {
+		queue.Unlock()
+		log.Warn("Chat queue: dropped duplicate message for ", channelName, ": ", message)
+		return
+	}
+
+	parts := splitChatMessage(message, chatMessageMaxLength)
+	if queue.laneSize > 0 && len(channel.lanes[priority])+len(parts) > queue.laneSize {
+		queue.Unlock()
+		log.Warn("Chat queue: lane ", priority, " of ", channelName, " is full, dropped message: ", message)
+		return
+	}
+
+	channel.recent[message] = now
+	channel.lanes[priority] = append(channel.lanes[priority], parts...)
+	queue.Unlock()
+
+	select {
+	case queue.wake <- true:
+	default:
+	}
+}
+
+// channel returns the queue of the channel and creates it if needed, the queue has to be locked
+func (queue *TwitchChatQueue) channel(name string) *TwitchChatQueueChannel {
+	channel, ok := queue.channels[name]
+	if ok {
+		return channel
+	}
+
+	limit := queue.limit
+	if queue.modChannels[name] {
+		limit = queue.modLimit
+	}
+
+	channel = &TwitchChatQueueChannel{
+		limit:  limit,
+		recent: make(map[string]time.Time),
+	}
+	queue.channels[name] = channel
+
+	return channel
+}
+
+// sender sends the queued messages as soon as the rate limits of the channels allow it
+func (queue *TwitchChatQueue) sender() {
+	for {
+		wait := queue.sendNext()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-queue.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// sendNext sends as many messages as the rate limits allow and returns the time until
+// the next send of a waiting channel. A channel never sends more than its limit within
+// any chatRateWindow because Twitch locks the bot out for 30 minutes otherwise.
+func (queue *TwitchChatQueue) sendNext() time.Duration {
+	type outgoing struct {
+		channel string
+		message string
+	}
+	var messages []outgoing
+	wait := time.Minute
+
+	queue.Lock()
+	now := queue.now()
+	for name, channel := range queue.channels {
+		expired := 0
+		for expired < len(channel.sentAt) && now.Sub(channel.sentAt[expired]) >= chatRateWindow {
+			expired++
+		}
+		channel.sentAt = channel.sentAt[expired:]
+
+		for priority := range channel.lanes {
+			for len(channel.lanes[priority]) > 0 && len(channel.sentAt) < channel.limit {
+				messages = append(messages, outgoing{name, channel.lanes[priority][0]})
+				channel.lanes[priority] = channel.lanes[priority][1:]
+				channel.sentAt = append(channel.sentAt, now)
+			}
+		}
+
+		// the oldest send leaves the window first
+		if channel.queued() > 0 && len(channel.sentAt) > 0 {
+			next := channel.sentAt[0].Add(chatRateWindow).Sub(now)
+			if next < wait {
+				wait = next
+			}
+		}
+	}
+	queue.Unlock()
+
+	for _, m := range messages {
+		queue.send(m.channel, m.message)
+	}
+
+	if wait < 10*time.Millisecond {
+		wait = 10 * time.Millisecond
+	}
+
+	return wait
+}
+
+// queued returns the number of waiting messages, the queue has to be locked
+func (channel *TwitchChatQueueChannel) queued() int {
+	count := 0
+	for _, lane := range channel.lanes {
+		count += len(lane)
+	}
+
+	return count
+}
+
+// isChatCommand returns true for commands like /ban or .timeout, /me and .me are chat messages
+func isChatCommand(message string) bool {
+	if strings.HasPrefix(message, "/me ") || strings.HasPrefix(message, ".me ") {
+		return false
+	}
+
+	return strings.HasPrefix(message, "/") || strings.HasPrefix(message, ".")
+}
+
+// splitChatMessage splits the message at spaces into parts of at most maxLength characters,
+// a leading /me or .me is repeated in every part and other commands are never split
+func splitChatMessage(message string, maxLength int) []string {
+	prefix := ""
+	if strings.HasPrefix(message, "/me ") || strings.HasPrefix(message, ".me ") {
+		prefix = message[:len("/me ")]
+		message = strings.TrimSpace(message[len(prefix):])
+	} else if isChatCommand(message) {
+		return []string{message}
+	}
+
+	maxLength -= len([]rune(prefix))
+
+	var parts []string
+	runes := []rune(message)
+	for len(runes) > maxLength {
+		end := maxLength
+		for i := maxLength; i > 0; i-- {
+			if runes[i] == ' ' {
+				end = i
+				break
+			}
+		}
+
+		parts = append(parts, prefix+strings.TrimSpace(string(runes[:end])))
+		runes = []rune(strings.TrimSpace(string(runes[end:])))
+	}
+	if len(runes) > 0 {
+		parts = append(parts, prefix+string(runes))
+	}
+
+	return parts
+}
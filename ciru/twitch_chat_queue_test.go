@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestChatQueue returns a queue without sender whose clock only moves with the returned function
+func newTestChatQueue(limit int, sent *[]time.Time) (*TwitchChatQueue, func(time.Duration)) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	queue := &TwitchChatQueue{
+		Mutex:       &sync.Mutex{},
+		wake:        make(chan bool, 1),
+		limit:       limit,
+		modChannels: make(map[string]bool),
+		channels:    make(map[string]*TwitchChatQueueChannel),
+		now: func() time.Time {
+			return now
+		},
+	}
+	queue.send = func(channel string, message string) {
+		*sent = append(*sent, now)
+	}
+
+	return queue, func(d time.Duration) {
+		now = now.Add(d)
+	}
+}
+
+func TestChatQueueRateLimit(t *testing.T) {
+	const limit = 20
+	var sent []time.Time
+	queue, advance := newTestChatQueue(limit, &sent)
+
+	// a quiet period before the burst must not allow more messages in the next window
+	queue.enqueue("channel", "first", chatPriorityAutomatic)
+	queue.sendNext()
+	advance(5 * time.Minute)
+
+	for i := 0; i < 5*limit; i++ {
+		queue.enqueue("channel", "message "+strconv.Itoa(i), chatPriorityAutomatic)
+	}
+
+	for i := 0; i < 1000 && len(sent) < 5*limit+1; i++ {
+		wait := queue.sendNext()
+		// the sender is also woken up early by new messages
+		if i%3 == 0 {
+			wait /= 2
+		}
+		advance(wait)
+	}
+
+	if len(sent) != 5*limit+1 {
+		t.Fatalf("sent %d messages, want %d", len(sent), 5*limit+1)
+	}
+
+	for i := range sent {
+		count := 0
+		for _, sentAt := range sent[i:] {
+			if sentAt.Sub(sent[i]) < chatRateWindow {
+				count++
+			}
+		}
+		if count > limit {
+			t.Fatalf("sent %d messages within 30 seconds after %v, the limit is %d", count, sent[i], limit)
+		}
+	}
+}
+
+func TestChatQueueWait(t *testing.T) {
+	var sent []time.Time
+	queue, advance := newTestChatQueue(2, &sent)
+
+	queue.enqueue("channel", "a", chatPriorityAutomatic)
+	queue.sendNext()
+	advance(10 * time.Second)
+	queue.enqueue("channel", "b", chatPriorityAutomatic)
+	queue.enqueue("channel", "c", chatPriorityAutomatic)
+
+	// c has to wait until a leaves the window
+	if wait := queue.sendNext(); wait != 20*time.Second {
+		t.Errorf("got wait %v, want 20s", wait)
+	}
+	if len(sent) != 2 {
+		t.Errorf("sent %d messages, want 2", len(sent))
+	}
+
+	advance(20 * time.Second)
+	queue.sendNext()
+	if len(sent) != 3 {
+		t.Errorf("sent %d messages, want 3", len(sent))
+	}
+}
+
+func TestSplitChatMessage(t *testing.T) {
+	tests := []struct {
+		message string
+		want    []string
+	}{
+		{"hi there", []string{"hi there"}},
+		{"aaaa bbbb cccc", []string{"aaaa", "bbbb", "cccc"}},
+		{"/me aaaa bbbb", []string{"/me aaaa", "/me bbbb"}},
+		{".me aaaa bbbb", []string{".me aaaa", ".me bbbb"}},
+		{"/ban user a long reason", []string{"/ban user a long reason"}},
+		{".timeout user 600 a long reason", []string{".timeout user 600 a long reason"}},
+	}
+
+	for _, test := range tests {
+		got := splitChatMessage(test.message, 8)
+		if len(got) != len(test.want) {
+			t.Errorf("%q: got %q, want %q", test.message, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%q: got %q, want %q", test.message, got, test.want)
+				break
+			}
+		}
+	}
+}
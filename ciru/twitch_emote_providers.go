@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var errEmoteProviderNotFound = errors.New("emote provider: not found")
+
+// newTwitchEmoteProviders returns the providers of EMOTE_PROVIDERS in order of their priority
+func newTwitchEmoteProviders(httpClient *http.Client) []TwitchEmoteProvider {
+	enabled := "bttv,ffz,7tv"
+	if s := strings.TrimSpace(strings.ToLower(os.Getenv("EMOTE_PROVIDERS"))); s != "" {
+		enabled = s
+	}
+
+	var providers []TwitchEmoteProvider
+	for _, name := range strings.Split(enabled, ",") {
+		switch strings.TrimSpace(name) {
+		case "bttv":
+			providers = append(providers, &TwitchBTTVProvider{
+				baseURL:    emoteProviderURL("BTTV_API_URL", "https://api.betterttv.net"),
+				httpClient: httpClient,
+			})
+		case "ffz":
+			providers = append(providers, &TwitchFFZProvider{
+				baseURL:    emoteProviderURL("FFZ_API_URL", "https://api.frankerfacez.com"),
+				httpClient: httpClient,
+			})
+		case "7tv":
+			providers = append(providers, &TwitchSevenTVProvider{
+				baseURL:    emoteProviderURL("SEVENTV_API_URL", "https://7tv.io"),
+				httpClient: httpClient,
+			})
+		case "":
+		default:
+			log.Error("Emote providers: unknown provider ", name)
+		}
+	}
+
+	return providers
+}
+
+func emoteProviderURL(name string, def string) string {
+	if s := strings.Trim(os.Getenv(name), " /"); s != "" {
+		return s
+	}
+
+	return def
+}
+
+// loadThirdPartyEmotes refreshes the global and channel emotes of all providers
+func (twitch *Twitch) loadThirdPartyEmotes() {
+	for _, provider := range twitch.emoteProviders {
+		if emotes, err := provider.globalEmotes(); err != nil {
+			log.Error("Emote provider ", provider.name(), ": global emotes: ", err)
+		} else {
+			twitch.emotes.set(provider.name()+":global", emotes)
+		}
+
+		for _, channel := range twitch.channels {
+			if emotes, err := provider.channelEmotes(channel.id); err != nil {
+				log.Error("Emote provider ", provider.name(), ": channel emotes of ", channel.name, ": ", err)
+			} else {
+				twitch.emotes.set(provider.name()+":"+channel.id, emotes)
+			}
+		}
+	}
+}
+
+// thirdPartyEmotes returns the emote sets of all providers by emote code in order of their priority,
+// channel emotes come before global emotes and earlier providers before later ones
+func (twitch *Twitch) thirdPartyEmotes(channel *TwitchChannel) []map[string]*TwitchFragmentEmote {
+	var sets []map[string]*TwitchFragmentEmote
+
+	if channel != nil {
+		for _, provider := range twitch.emoteProviders {
+			sets = twitch.appendEmoteSet(sets, provider.name()+":"+channel.id, func() (interface{}, error) {
+				return provider.channelEmotes(channel.id)
+			})
+		}
+	}
+
+	for _, provider := range twitch.emoteProviders {
+		sets = twitch.appendEmoteSet(sets, provider.name()+":global", func() (interface{}, error) {
+			return provider.globalEmotes()
+		})
+	}
+
+	return sets
+}
+
+// appendEmoteSet appends the cached emote set, sets of unreachable providers are skipped.
+// It is called for every chat message and never waits for a provider, missing sets are
+// fetched in the background and the third_party_emotes cron keeps them up to date.
+func (twitch *Twitch) appendEmoteSet(sets []map[string]*TwitchFragmentEmote, key string, fetch func() (interface{}, error)) []map[string]*TwitchFragmentEmote {
+	emotes, ok := twitch.emotes.cached(key, fetch)
+	if !ok {
+		return sets
+	}
+
+	return append(sets, emotes.(map[string]*TwitchFragmentEmote))
+}
+
+// emoteProviderRequest unmarshals the json response of the url into v,
+// errEmoteProviderNotFound is returned for unknown channels
+func emoteProviderRequest(httpClient *http.Client, url string, v interface{}) error {
+	res, err := httpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return errEmoteProviderNotFound
+	} else if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.New("emote provider: got " + res.Status + " as response")
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// https:// is missing in some urls of the providers
+func absoluteURL(url string) string {
+	if strings.HasPrefix(url, "//") {
+		return "https:" + url
+	}
+
+	return url
+}
+
+func (provider *TwitchBTTVProvider) name() string {
+	return "bttv"
+}
+
+func (provider *TwitchBTTVProvider) globalEmotes() (map[string]*TwitchFragmentEmote, error) {
+	var res []TwitchBTTVEmote
+	err := emoteProviderRequest(provider.httpClient, provider.baseURL+"/3/cached/emotes/global", &res)
+	if err != nil {
+		return nil, err
+	}
+
+	return provider.emotes(res), nil
+}
+
+func (provider *TwitchBTTVProvider) channelEmotes(channelID string) (map[string]*TwitchFragmentEmote, error) {
+	var res struct {
+		ChannelEmotes []TwitchBTTVEmote `json:"channelEmotes"`
+		SharedEmotes  []TwitchBTTVEmote `json:"sharedEmotes"`
+	}
+	err := emoteProviderRequest(provider.httpClient, provider.baseURL+"/3/cached/users/twitch/"+channelID, &res)
+	if err == errEmoteProviderNotFound {
+		return make(map[string]*TwitchFragmentEmote), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return provider.emotes(append(res.SharedEmotes, res.ChannelEmotes...)), nil
+}
+
+func (provider *TwitchBTTVProvider) emotes(bttvEmotes []TwitchBTTVEmote) map[string]*TwitchFragmentEmote {
+	emotes := make(map[string]*TwitchFragmentEmote)
+	for _, emote := range bttvEmotes {
+		url := "https://cdn.betterttv.net/emote/" + emote.ID + "/"
+		emotes[emote.Code] = &TwitchFragmentEmote{
+			ID:       emote.ID,
+			Provider: provider.name(),
+			URLs: TwitchImageURLs{
+				X1: url + "1x",
+				X2: url + "2x",
+				X4: url + "3x",
+			},
+		}
+	}
+
+	return emotes
+}
+
+func (provider *TwitchFFZProvider) name() string {
+	return "ffz"
+}
+
+func (provider *TwitchFFZProvider) globalEmotes() (map[string]*TwitchFragmentEmote, error) {
+	var res struct {
+		DefaultSets []int                        `json:"default_sets"`
+		Sets        map[string]TwitchFFZEmoteSet `json:"sets"`
+	}
+	err := emoteProviderRequest(provider.httpClient, provider.baseURL+"/v1/set/global", &res)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the default sets are available for everyone
+	var sets []TwitchFFZEmoteSet
+	for _, id := range res.DefaultSets {
+		if set, ok := res.Sets[strconv.Itoa(id)]; ok {
+			sets = append(sets, set)
+		}
+	}
+
+	return provider.emotes(sets), nil
+}
+
+func (provider *TwitchFFZProvider) channelEmotes(channelID string) (map[string]*TwitchFragmentEmote, error) {
+	var res struct {
+		Sets map[string]TwitchFFZEmoteSet `json:"sets"`
+	}
+	err := emoteProviderRequest(provider.httpClient, provider.baseURL+"/v1/room/id/"+channelID, &res)
+	if err == errEmoteProviderNotFound {
+		return make(map[string]*TwitchFragmentEmote), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var sets []TwitchFFZEmoteSet
+	for _, set := range res.Sets {
+		sets = append(sets, set)
+	}
+
+	return provider.emotes(sets), nil
+}
+
+func (provider *TwitchFFZProvider) emotes(sets []TwitchFFZEmoteSet) map[string]*TwitchFragmentEmote {
+	emotes := make(map[string]*TwitchFragmentEmote)
+	for _, set := range sets {
+		for _, emote := range set.Emoticons {
+			urls := TwitchImageURLs{
+				X1: absoluteURL(emote.URLs["1"]),
+				X2: absoluteURL(emote.URLs["2"]),
+				X4: absoluteURL(emote.URLs["4"]),
+			}
+			// not every emote is available in all sizes
+			if urls.X2 == "" {
+				urls.X2 = urls.X1
+			}
+			if urls.X4 == "" {
+				urls.X4 = urls.X2
+			}
+
+			emotes[emote.Name] = &TwitchFragmentEmote{
+				ID:       strconv.Itoa(emote.ID),
+				Provider: provider.name(),
+				URLs:     urls,
+			}
+		}
+	}
+
+	return emotes
+}
+
+func (provider *TwitchSevenTVProvider) name() string {
+	return "7tv"
+}
+
+func (provider *TwitchSevenTVProvider) globalEmotes() (map[string]*TwitchFragmentEmote, error) {
+	var res struct {
+		Emotes []TwitchSevenTVEmote `json:"emotes"`
+	}
+	err := emoteProviderRequest(provider.httpClient, provider.baseURL+"/v3/emote-sets/global", &res)
+	if err != nil {
+		return nil, err
+	}
+
+	return provider.emotes(res.Emotes), nil
+}
+
+func (provider *TwitchSevenTVProvider) channelEmotes(channelID string) (map[string]*TwitchFragmentEmote, error) {
+	var res struct {
+		EmoteSet struct {
+			Emotes []TwitchSevenTVEmote `json:"emotes"`
+		} `json:"emote_set"`
+	}
+	err := emoteProviderRequest(provider.httpClient, provider.baseURL+"/v3/users/twitch/"+channelID, &res)
+	if err == errEmoteProviderNotFound {
+		return make(map[string]*TwitchFragmentEmote), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return provider.emotes(res.EmoteSet.Emotes), nil
+}
+
+func (provider *TwitchSevenTVProvider) emotes(sevenTVEmotes []TwitchSevenTVEmote) map[string]*TwitchFragmentEmote {
+	emotes := make(map[string]*TwitchFragmentEmote)
+	for _, emote := range sevenTVEmotes {
+		url := absoluteURL(emote.Data.Host.URL) + "/"
+		emotes[emote.Name] = &TwitchFragmentEmote{
+			ID:       emote.ID,
+			Provider: provider.name(),
+			URLs: TwitchImageURLs{
+				X1: url + "1x.webp",
+				X2: url + "2x.webp",
+				X4: url + "4x.webp",
+			},
+		}
+	}
+
+	return emotes
+}
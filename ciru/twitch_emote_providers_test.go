@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newEmoteProviderServer serves fixtures of the provider apis, the channel 404 is unknown
+// to every provider and the channel 500 fails
+func newEmoteProviderServer() *httptest.Server {
+	fixtures := map[string]string{
+		"/3/cached/emotes/global": `[{"id":"bg1","code":"BTTVGlobal"}]`,
+		"/3/cached/users/twitch/123": `{
+			"channelEmotes": [{"id":"bc1","code":"BTTVChannel"}],
+			"sharedEmotes": [{"id":"bs1","code":"BTTVShared"}]
+		}`,
+		"/v1/set/global": `{
+			"default_sets": [3],
+			"sets": {
+				"3": {"emoticons": [{"id":1,"name":"FFZDefault","urls":{"1":"//cdn.frankerfacez.com/emote/1/1","4":"//cdn.frankerfacez.com/emote/1/4"}}]},
+				"4": {"emoticons": [{"id":2,"name":"FFZHidden","urls":{"1":"//cdn.frankerfacez.com/emote/2/1"}}]}
+			}
+		}`,
+		"/v1/room/id/123": `{
+			"sets": {"5": {"emoticons": [{"id":5,"name":"FFZChannel","urls":{"1":"https://cdn.frankerfacez.com/emote/5/1"}}]}}
+		}`,
+		"/v3/emote-sets/global": `{"emotes": [{"id":"sg1","name":"SevenGlobal","data":{"host":{"url":"//cdn.7tv.app/emote/sg1"}}}]}`,
+		"/v3/users/twitch/123": `{
+			"emote_set": {"emotes": [{"id":"sc1","name":"SevenChannel","data":{"host":{"url":"//cdn.7tv.app/emote/sc1"}}}]}
+		}`,
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/3/cached/users/twitch/500", "/v1/room/id/500", "/v3/users/twitch/500":
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		fixture, ok := fixtures[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(fixture))
+	}))
+}
+
+func newTestEmoteProviders(server *httptest.Server) []TwitchEmoteProvider {
+	return []TwitchEmoteProvider{
+		&TwitchBTTVProvider{baseURL: server.URL, httpClient: server.Client()},
+		&TwitchFFZProvider{baseURL: server.URL, httpClient: server.Client()},
+		&TwitchSevenTVProvider{baseURL: server.URL, httpClient: server.Client()},
+	}
+}
+
+func TestEmoteProviders(t *testing.T) {
+	server := newEmoteProviderServer()
+	defer server.Close()
+
+	providers := newTestEmoteProviders(server)
+
+	tests := []struct {
+		provider TwitchEmoteProvider
+		global   bool
+		code     string
+		id       string
+		urls     TwitchImageURLs
+	}{
+		{providers[0], true, "BTTVGlobal", "bg1", TwitchImageURLs{
+			X1: "https://cdn.betterttv.net/emote/bg1/1x",
+			X2: "https://cdn.betterttv.net/emote/bg1/2x",
+			X4: "https://cdn.betterttv.net/emote/bg1/3x",
+		}},
+		{providers[0], false, "BTTVChannel", "bc1", TwitchImageURLs{
+			X1: "https://cdn.betterttv.net/emote/bc1/1x",
+			X2: "https://cdn.betterttv.net/emote/bc1/2x",
+			X4: "https://cdn.betterttv.net/emote/bc1/3x",
+		}},
+		{providers[0], false, "BTTVShared", "bs1", TwitchImageURLs{
+			X1: "https://cdn.betterttv.net/emote/bs1/1x",
+			X2: "https://cdn.betterttv.net/emote/bs1/2x",
+			X4: "https://cdn.betterttv.net/emote/bs1/3x",
+		}},
+		// the missing 2x falls back to 1x
+		{providers[1], true, "FFZDefault", "1", TwitchImageURLs{
+			X1: "https://cdn.frankerfacez.com/emote/1/1",
+			X2: "https://cdn.frankerfacez.com/emote/1/1",
+			X4: "https://cdn.frankerfacez.com/emote/1/4",
+		}},
+		{providers[1], false, "FFZChannel", "5", TwitchImageURLs{
+			X1: "https://cdn.frankerfacez.com/emote/5/1",
+			X2: "https://cdn.frankerfacez.com/emote/5/1",
+			X4: "https://cdn.frankerfacez.com/emote/5/1",
+		}},
+		{providers[2], true, "SevenGlobal", "sg1", TwitchImageURLs{
+			X1: "https://cdn.7tv.app/emote/sg1/1x.webp",
+			X2: "https://cdn.7tv.app/emote/sg1/2x.webp",
+			X4: "https://cdn.7tv.app/emote/sg1/4x.webp",
+		}},
+		{providers[2], false, "SevenChannel", "sc1", TwitchImageURLs{
+			X1: "https://cdn.7tv.app/emote/sc1/1x.webp",
+			X2: "https://cdn.7tv.app/emote/sc1/2x.webp",
+			X4: "https://cdn.7tv.app/emote/sc1/4x.webp",
+		}},
+	}
+
+	for _, test := range tests {
+		var emotes map[string]*TwitchFragmentEmote
+		var err error
+		if test.global {
+			emotes, err = test.provider.globalEmotes()
+		} else {
+			emotes, err = test.provider.channelEmotes("123")
+		}
+		if err != nil {
+			t.Fatalf("%s: %s: %v", test.provider.name(), test.code, err)
+		}
+
+		emote, ok := emotes[test.code]
+		if !ok {
+			t.Errorf("%s: %s is missing", test.provider.name(), test.code)
+			continue
+		}
+		if emote.ID != test.id || emote.Provider != test.provider.name() || emote.URLs != test.urls {
+			t.Errorf("%s: %s is %+v", test.provider.name(), test.code, emote)
+		}
+	}
+}
+
+func TestEmoteProvidersFFZDefaultSets(t *testing.T) {
+	server := newEmoteProviderServer()
+	defer server.Close()
+
+	emotes, err := newTestEmoteProviders(server)[1].globalEmotes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := emotes["FFZHidden"]; ok {
+		t.Error("emotes of sets which are not default sets are global emotes")
+	}
+	if len(emotes) != 1 {
+		t.Errorf("got %d global emotes, want 1", len(emotes))
+	}
+}
+
+func TestEmoteProvidersChannelErrors(t *testing.T) {
+	server := newEmoteProviderServer()
+	defer server.Close()
+
+	for _, provider := range newTestEmoteProviders(server) {
+		emotes, err := provider.channelEmotes("404")
+		if err != nil || emotes == nil || len(emotes) != 0 {
+			t.Errorf("%s: unknown channel returned %v, %v, want an empty set", provider.name(), emotes, err)
+		}
+
+		if _, err := provider.channelEmotes("500"); err == nil {
+			t.Errorf("%s: failed request returned no error", provider.name())
+		}
+	}
+}
+
+func TestMessageFragmentsThirdPartyEmotes(t *testing.T) {
+	server := newEmoteProviderServer()
+	defer server.Close()
+
+	bttv := newTestEmoteProviders(server)[0]
+	global, err := bttv.globalEmotes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	twitch := &Twitch{
+		emoteProviders: []TwitchEmoteProvider{bttv},
+		emotes:         newCache("test_third_party_emotes", 0, time.Hour, 0, nil),
+	}
+	twitch.emotes.set("bttv:global", global)
+
+	var emotes []*TwitchEmote
+	err = json.Unmarshal([]byte(`[{"id":"25","ranges":[{"from":0,"to":4}]}]`), &emotes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fragments := twitch.messageFragments(nil, "Kappa BTTVGlobal", emotes, 0)
+
+	want := []TwitchMessageFragment{
+		{Type: "emote", Text: "Kappa", From: 0, To: 5},
+		{Type: "text", Text: " ", From: 5, To: 6},
+		{Type: "emote", Text: "BTTVGlobal", From: 6, To: 16},
+	}
+	if len(fragments) != len(want) {
+		t.Fatalf("got %d fragments, want %d", len(fragments), len(want))
+	}
+	for i, fragment := range fragments {
+		if fragment.Type != want[i].Type || fragment.Text != want[i].Text || fragment.From != want[i].From || fragment.To != want[i].To {
+			t.Errorf("fragment %d is %+v, want %+v", i, fragment, want[i])
+		}
+	}
+
+	if emote := fragments[0].Emote; emote == nil || emote.Provider != "twitch" || emote.ID != "25" {
+		t.Errorf("Kappa is %+v, want the twitch emote 25", emote)
+	}
+	if emote := fragments[2].Emote; emote == nil || emote.Provider != "bttv" || emote.ID != "bg1" {
+		t.Errorf("BTTVGlobal is %+v, want the bttv emote bg1", emote)
+	}
+}
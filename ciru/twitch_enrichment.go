@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+func newTwitchEnrichment(enrich func(channel *TwitchChannel, m TwitchMessage) TwitchMessage) *TwitchEnrichment {
+	queueSize := envInt("ENRICHMENT_QUEUE_SIZE", 1000)
+
+	enrichment := &TwitchEnrichment{
+		ordered:  make(chan *TwitchEnrichmentJob, queueSize),
+		pending:  make(chan *TwitchEnrichmentJob, queueSize),
+		deadline: envDuration("ENRICHMENT_DEADLINE", time.Second),
+		users:    newTwitchUserLookup(),
+	}
+
+	enrichment.enrichMessage = enrich
+
+	for i := 0; i < envInt("ENRICHMENT_WORKERS", 8); i++ {
+		go func() {
+			for job := range enrichment.pending {
+				job.enriched <- job.enrich()
+			}
+		}()
+	}
+	go enrichment.broadcaster()
+
+	return enrichment
+}
+
+// enqueue enriches the message in the background,
+// the messages are broadcasted in the order they were enqueued
+func (enrichment *TwitchEnrichment) enqueue(channel *TwitchChannel, m TwitchMessage) {
+	enrichment.enqueueEvent(m.ChannelName, m, func() interface{} {
+		return enrichment.enrichMessage(channel, m)
+	})
+}
+
+// enqueueEvent enriches the event in the background and broadcasts it in order with the messages,
+// data is broadcasted if the enrichment misses the deadline
+func (enrichment *TwitchEnrichment) enqueueEvent(channelName string, data interface{}, enrich func() interface{}) {
+	job := &TwitchEnrichmentJob{
+		channelName: channelName,
+		data:        data,
+		enrich:      enrich,
+		deadline:    time.Now().Add(enrichment.deadline),
+		enriched:    make(chan interface{}, 1),
+	}
+
+	enrichment.ordered <- job
+	enrichment.pending <- job
+}
+
+// broadcaster waits for each message until it is enriched or
+// its deadline is reached, in that case the unenriched message is sent
+func (enrichment *TwitchEnrichment) broadcaster() {
+	for job := range enrichment.ordered {
+		timer := time.NewTimer(time.Until(job.deadline))
+
+		select {
+		case data := <-job.enriched:
+			timer.Stop()
+			hugo.hub.broadcast(job.channelName, data)
+		case <-timer.C:
+			log.Warn("Enrichment: deadline reached for ", dataType(job.data), " in ", job.channelName)
+			hugo.hub.broadcast(job.channelName, job.data)
+		}
+	}
+}
+
+// enrichmentStage runs the stage and returns false if it failed or took longer than the timeout.
+// The stage must not modify anything which is used after a timeout.
+func enrichmentStage(name string, timeout time.Duration, stage func() error) bool {
+	done := make(chan error, 1)
+	go func() {
+		done <- stage()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Error("Enrichment: stage ", name, ": ", err)
+			return false
+		}
+		return true
+	case <-timer.C:
+		log.Warn("Enrichment: stage ", name, " timed out")
+		return false
+	}
+}
+
+// enrichMessage adds the twitch profile and the nse data of the user to the message
+func (twitch *Twitch) enrichMessage(channel *TwitchChannel, m TwitchMessage) TwitchMessage {
+	var twitchUserDetails *TwitchUserDetails
+	if enrichmentStage("twitch user", envDuration("ENRICHMENT_TWITCH_TIMEOUT", 500*time.Millisecond), func() (err error) {
+		twitchUserDetails, err = twitch.getUser(m.User.Username)
+		return err
+	}) {
+		m.User.LogoURL = twitchUserDetails.LogoURL
+		if m.User.ID == "" {
+			m.User.ID = twitchUserDetails.ID
+		}
+	}
+
+	enriched := m
+	if enrichmentStage("nse user", envDuration("ENRICHMENT_NSE_TIMEOUT", 500*time.Millisecond), func() error {
+		return twitch.enrichNSEUser(channel, &enriched)
+	}) {
+		m = enriched
+	}
+
+	if channel != nil {
+		go twitch.checkFirstChatter(channel, m.User.Username, m.User.ID, m.User.IsBroadcaster)
+		twitch.recordChatActivity(channel, m)
+	}
+
+	return m
+}
+
+// enrichNSEUser adds the data of the user from steve to the message and registers unknown users
+func (twitch *Twitch) enrichNSEUser(channel *TwitchChannel, m *TwitchMessage) error {
+	user, err := twitch.enrichment.users.get(m.User.Username, m.User.ID)
+	if err == errSteveNotFound {
+		if channel != nil {
+			twitch.registerUser(channel, m)
+			twitch.enrichment.users.cache.invalidate(m.User.Username)
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(user, &m.User)
+}
+
+func newTwitchUserLookup() *TwitchUserLookup {
+	ttl := envDuration("ENRICHMENT_CACHE_TTL", 10*time.Second)
+
+	return &TwitchUserLookup{
+		Mutex: &sync.Mutex{},
+		// unknown users are cached as well
+		cache: newCache("nse_users", envInt("ENRICHMENT_CACHE_SIZE", 10000), ttl, ttl, func(err error) bool {
+			return err == errSteveNotFound
+		}),
+		batchWindow: envDuration("ENRICHMENT_BATCH_WINDOW", 20*time.Millisecond),
+		batchSize:   envInt("ENRICHMENT_BATCH_SIZE", 50),
+		batch:       make(map[string]*TwitchUserLookupRequest),
+	}
+}
+
+// get returns the user from the cache or waits until it was fetched with the next batch.
+// errSteveNotFound is returned for unknown users.
+func (lookup *TwitchUserLookup) get(username string, userID string) (json.RawMessage, error) {
+	user, err := lookup.cache.get(username, func() (interface{}, error) {
+		return lookup.fetchBatched(username, userID)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user.(json.RawMessage), nil
+}
+
+// fetchBatched adds the user to the next batch and waits for the result,
+// concurrent lookups of the same user are already coalesced by the cache
+func (lookup *TwitchUserLookup) fetchBatched(username string, userID string) (json.RawMessage, error) {
+	request := &TwitchUserLookupRequest{
+		userID: userID,
+		done:   make(chan bool),
+	}
+
+	lookup.Lock()
+	lookup.batch[username] = request
+	if len(lookup.batch) >= lookup.batchSize {
+		lookup.flushLocked()
+	} else if lookup.batchTimer == nil {
+		lookup.batchTimer = time.AfterFunc(lookup.batchWindow, lookup.flush)
+	}
+	lookup.Unlock()
+
+	<-request.done
+	return request.user, request.err
+}
+
+func (lookup *TwitchUserLookup) flush() {
+	lookup.Lock()
+	defer lookup.Unlock()
+
+	lookup.flushLocked()
+}
+
+// flushLocked fetches the current batch, the lookup has to be locked
+func (lookup *TwitchUserLookup) flushLocked() {
+	if lookup.batchTimer != nil {
+		lookup.batchTimer.Stop()
+		lookup.batchTimer = nil
+	}
+
+	if len(lookup.batch) == 0 {
+		return
+	}
+
+	batch := lookup.batch
+	lookup.batch = make(map[string]*TwitchUserLookupRequest)
+	go lookup.fetch(batch)
+}
+
+// fetch requests all users of the batch at once from steve
+func (lookup *TwitchUserLookup) fetch(batch map[string]*TwitchUserLookupRequest) {
+	var (
+		usernames []string
+		body      []map[string]string
+	)
+	for username, request := range batch {
+		usernames = append(usernames, username)
+		body = append(body, map[string]string{
+			"username": username,
+			"twitchID": request.userID,
+		})
+	}
+
+	// the results are in the order of the request
+	var results []struct {
+		Found bool            `json:"found"`
+		User  json.RawMessage `json:"user"`
+	}
+	err := steveRequest(http.MethodPost, "/users/lookup", body, &results)
+	if err == nil && len(results) != len(usernames) {
+		err = errors.New("steve: got " + strconv.Itoa(len(results)) + " users for " + strconv.Itoa(len(usernames)) + " lookups")
+	}
+
+	for i, username := range usernames {
+		request := batch[username]
+		if err != nil {
+			request.err = err
+		} else if !results[i].Found {
+			request.err = errSteveNotFound
+		} else {
+			request.user = results[i].User
+		}
+
+		close(request.done)
+	}
+}
@@ -3,10 +3,6 @@ package main
 import (
 	"crypto/md5"
 	"encoding/hex"
-	"encoding/json"
-	"io/ioutil"
-	"net/http"
-	"os"
 	"strconv"
 	"strings"
 
@@ -22,8 +18,10 @@ func (twitch *Twitch) eventMessageReceived(t *twirgo.Twitch, event twirgo.EventM
 		ChannelName: event.Channel.Name,
 		Me:          event.Message.Me,
 		Highlighted: event.Message.Highlighted,
+		Bits:        event.Message.Bits,
 	}
 
+	m.User.ID = event.ChannelUser.User.ID
 	m.User.DisplayName = event.ChannelUser.User.DisplayName
 	m.User.Username = event.ChannelUser.User.Username
 	if event.ChannelUser.User.Color != "" {
@@ -43,33 +41,43 @@ func (twitch *Twitch) eventMessageReceived(t *twirgo.Twitch, event twirgo.EventM
 	m.User.SubscriberMonths = event.ChannelUser.SubscriberMonths
 	m.User.SubscriberBadgeMonths, _ = strconv.ParseInt(event.ChannelUser.Badges["subscriber"], 10, 64)
 
+	channel := twitch.channel(event.Channel.Name)
+
 	m.User.Badges = event.ChannelUser.Badges
-	twitch.RLock()
-	for name, version := range m.User.Badges {
-		if name == "subscriber" {
+	m.User.ResolvedBadges = twitch.resolveBadges(channel, m.User.Badges)
+	for _, badge := range m.User.ResolvedBadges {
+		// the subscriber badge has its own field
+		if badge.Set == "subscriber" {
+			m.User.SubscriberBadgeURL = badge.URLs.X4
 			continue
 		}
-		m.User.BadgeURLs = append(m.User.BadgeURLs, twitch.globalBadges[name][version].ImageURL)
+		m.User.BadgeURLs = append(m.User.BadgeURLs, badge.URLs.X4)
 	}
-	twitch.RUnlock()
 
 	if _, ok := event.ChannelUser.Badges["founder"]; ok {
 		m.User.IsFounder = true
 	}
 
-	// get user profile information
-	if twitchUserDetails, err := twitch.getUser(m.User.Username); err != nil {
-		log.Error(err)
-	} else {
-		m.User.LogoURL = twitchUserDetails.LogoURL
-		m.User.ID = twitchUserDetails.ID
-	}
+	if channel != nil {
+		twitch.trackChatVelocity(channel, m.User.Username)
+
+		// the chat log also contains messages hidden by the moderation
+		twitch.logChatMessage(channel, m)
 
-	twitch.RLock()
-	if badge, ok := twitch.subscriberBadges[m.User.SubscriberBadgeMonths]; ok {
-		m.User.SubscriberBadgeURL = badge.ImageURL
+		var emoteCount int
+		for _, ranges := range event.Message.Emotes {
+			emoteCount += len(ranges)
+		}
+
+		if !twitch.moderation.check(channel, &m, emoteCount) {
+			return
+		}
+
+		// overlays only show messages of the broadcaster and mods during a raid
+		if channel.raidProtectionActive() && !m.User.IsBroadcaster && !m.User.IsMod {
+			return
+		}
 	}
-	twitch.RUnlock()
 
 	for emoteID, ranges := range event.Message.Emotes {
 		e := &TwitchEmote{ID: emoteID}
@@ -86,29 +94,75 @@ func (twitch *Twitch) eventMessageReceived(t *twirgo.Twitch, event twirgo.EventM
 
 		m.Emotes = append(m.Emotes, e)
 	}
+	m.Fragments = twitch.messageFragments(channel, m.Content, m.Emotes, m.Bits)
 
-	// fetch nse data
-	r, err := http.Get(strings.Trim(os.Getenv("STEVE_URL"), " /") + "/user/" + m.User.Username)
-	if err == nil {
-		body, err := ioutil.ReadAll(r.Body)
-		if err == nil {
-			// we ignore any error on this
-			json.Unmarshal(body, &m.User)
-		}
+	// the profile and nse data are added in the background
+	twitch.enrichment.enqueue(channel, m)
+}
+
+func (twitch *Twitch) resetFirstChatter(channel *TwitchChannel, event string, stream TwitchStream) {
+	if event != streamOnline {
+		return
+	}
+
+	channel.Lock()
+	channel.firstChatter = ""
+	channel.Unlock()
+}
+
+// checkFirstChatter rewards the first user who writes in chat after the stream went online
+func (twitch *Twitch) checkFirstChatter(channel *TwitchChannel, username string, userID string, isBroadcaster bool) {
+	reputationPoints := envInt("FIRST_CHATTER_REPUTATION_POINTS", 0)
+	if reputationPoints <= 0 || isBroadcaster {
+		return
 	}
 
-	hugo.hub.broadcast(m)
+	channel.Lock()
+	if channel.stream == nil || channel.firstChatter != "" {
+		channel.Unlock()
+		return
+	}
+	channel.firstChatter = username
+	channel.Unlock()
+
+	log.Info("First chatter of ", channel.name, ": ", username)
+	addReputationPointsToUser(username, userID, reputationPoints)
 }
 
+// clearchat and clearmsg are broadcasted in order with the chat messages, without
+// the moderator action and the removed messages if they take longer than the deadline
 func (twitch *Twitch) eventClearchat(t *twirgo.Twitch, event twirgo.EventClearchat) {
-	hugo.hub.broadcast(TwitchClearchat{
-		Username: event.User.Username,
+	twitch.logChatTombstone(event.Channel.Name, event.User.Username, "")
+	twitch.enrichment.enqueueEvent(event.Channel.Name, TwitchClearchat{Username: event.User.Username}, func() interface{} {
+		return twitch.enrichClearchat(event.Channel.Name, event.User.Username)
 	})
 }
 
+// eventUsernotice handles raids, EventSub is optional and only a second source of them
+func (twitch *Twitch) eventUsernotice(t *twirgo.Twitch, event twirgo.EventUsernotice) {
+	if event.MsgID != "raid" {
+		return
+	}
+
+	channel := twitch.channel(event.Channel.Name)
+	if channel == nil {
+		return
+	}
+
+	viewers, _ := strconv.Atoi(event.Params["msg-param-viewerCount"])
+	raid := TwitchRaid{
+		UserID:      event.User.ID,
+		Username:    event.User.Username,
+		DisplayName: event.User.DisplayName,
+		Viewers:     viewers,
+	}
+
+	go twitch.raid(channel, raid)
+}
+
 func (twitch *Twitch) eventClearmsg(t *twirgo.Twitch, event twirgo.EventClearmsg) {
-	hugo.hub.broadcast(TwitchClearmsg{
-		Username: event.User.Username,
-		MsgID:    event.Message.ID,
+	twitch.logChatTombstone(event.Channel.Name, event.User.Username, event.Message.ID)
+	twitch.enrichment.enqueueEvent(event.Channel.Name, TwitchClearmsg{Username: event.User.Username, MsgID: event.Message.ID}, func() interface{} {
+		return twitch.enrichClearmsg(event.Channel.Name, event.User.Username, event.Message.ID)
 	})
 }
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+const (
+	// Notifications with an older timestamp are rejected to prevent replay attacks
+	eventSubMaxMessageAge = 10 * time.Minute
+
+	// Maximum size of a notification body
+	eventSubMaxBodySize = 1 << 20
+
+	// Notifications waiting per channel, further ones are dropped
+	eventSubQueueSize = 100
+)
+
+// eventSubTypes are the subscriptions which are created for every channel,
+// key: subscription type, value: name of the condition field holding the channel id
+var eventSubTypes = map[string]string{
+	"channel.follow":              "broadcaster_user_id",
+	"channel.raid":                "to_broadcaster_user_id",
+	"channel.poll.begin":          "broadcaster_user_id",
+	"channel.poll.progress":       "broadcaster_user_id",
+	"channel.poll.end":            "broadcaster_user_id",
+	"channel.prediction.begin":    "broadcaster_user_id",
+	"channel.prediction.progress": "broadcaster_user_id",
+	"channel.prediction.lock":     "broadcaster_user_id",
+	"channel.prediction.end":      "broadcaster_user_id",
+	"channel.hype_train.begin":    "broadcaster_user_id",
+	"channel.hype_train.progress": "broadcaster_user_id",
+	"channel.hype_train.end":      "broadcaster_user_id",
+}
+
+func newTwitchEventSub(httpClient *http.Client, oauthConfig *oauth2.Config) *TwitchEventSub {
+	eventSub := &TwitchEventSub{
+		Mutex:       &sync.Mutex{},
+		secret:      os.Getenv("TWITCH_EVENTSUB_SECRET"),
+		callbackURL: strings.TrimRight(os.Getenv("BASE_URL"), "/") + "/eventsub",
+		messageIDs:  make(map[string]time.Time),
+		handlers:    make(map[string]func(channel *TwitchChannel, event json.RawMessage)),
+		queues:      make(map[string]chan func()),
+	}
+
+	if eventSub.secret == "" || os.Getenv("BASE_URL") == "" {
+		log.Info("EventSub: TWITCH_EVENTSUB_SECRET or BASE_URL not set, EventSub is disabled")
+		return eventSub
+	}
+	eventSub.enabled = true
+
+	// subscriptions have to be managed with an app access token
+	credentials := &clientcredentials.Config{
+		ClientID:     oauthConfig.ClientID,
+		ClientSecret: oauthConfig.ClientSecret,
+		TokenURL:     oauthConfig.Endpoint.TokenURL,
+		AuthStyle:    oauth2.AuthStyleInParams,
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, httpClient)
+	eventSub.httpClient = credentials.Client(ctx)
+	eventSub.httpClient.Timeout = 3 * time.Second
+
+	return eventSub
+}
+
+// on registers the handler for a subscription type,
+// events without handler are broadcasted as they are
+func (eventSub *TwitchEventSub) on(subscriptionType string, handler func(channel *TwitchChannel, event json.RawMessage)) {
+	eventSub.Lock()
+	defer eventSub.Unlock()
+	eventSub.handlers[subscriptionType] = handler
+}
+
+func (eventSub *TwitchEventSub) handler(w http.ResponseWriter, r *http.Request) {
+	if !eventSub.enabled {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, eventSubMaxBodySize))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	messageID := r.Header.Get("Twitch-Eventsub-Message-Id")
+	timestamp := r.Header.Get("Twitch-Eventsub-Message-Timestamp")
+
+	if !eventSub.verifySignature(messageID, timestamp, body, r.Header.Get("Twitch-Eventsub-Message-Signature")) {
+		log.Error("EventSub: invalid signature for message ", messageID)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	sentAt, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil || time.Since(sentAt) > eventSubMaxMessageAge || time.Until(sentAt) > eventSubMaxMessageAge {
+		log.Error("EventSub: rejecting message ", messageID, " with timestamp ", timestamp)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if eventSub.isDuplicate(messageID) {
+		log.Debug("EventSub: ignoring duplicate message ", messageID)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var notification struct {
+		Challenge    string `json:"challenge"`
+		Subscription struct {
+			ID        string            `json:"id"`
+			Type      string            `json:"type"`
+			Status    string            `json:"status"`
+			Condition map[string]string `json:"condition"`
+		} `json:"subscription"`
+		Event json.RawMessage `json:"event"`
+	}
+	err = json.Unmarshal(body, &notification)
+	if err != nil {
+		log.Error("EventSub: could not unmarshal message: ", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch r.Header.Get("Twitch-Eventsub-Message-Type") {
+	case "webhook_callback_verification":
+		log.Info("EventSub: verifying subscription ", notification.Subscription.Type)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(notification.Challenge))
+
+	case "revocation":
+		log.Error("EventSub: subscription ", notification.Subscription.Type, " revoked: ", notification.Subscription.Status)
+		w.WriteHeader(http.StatusNoContent)
+
+	case "notification":
+		w.WriteHeader(http.StatusNoContent)
+
+		fieldName := eventSubTypes[notification.Subscription.Type]
+		channel := twitch.channelByID(notification.Subscription.Condition[fieldName])
+		if channel == nil {
+			log.Error("EventSub: notification for unknown channel: ", notification.Subscription.Condition)
+			return
+		}
+
+		eventSub.Lock()
+		handler, ok := eventSub.handlers[notification.Subscription.Type]
+		eventSub.Unlock()
+
+		log.Debugf("EventSub: %s for %s: %s", notification.Subscription.Type, channel.name, notification.Event)
+		eventSub.dispatch(channel, func() {
+			if ok {
+				handler(channel, notification.Event)
+			} else {
+				hugo.hub.broadcast(channel.name, TwitchEventSubEvent{
+					Type:  notification.Subscription.Type,
+					Event: notification.Event,
+				})
+			}
+		})
+
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// dispatch runs the notifications of a channel one after another in the order they were received,
+// otherwise a late progress could be handled after the end of a hype train, poll or prediction
+func (eventSub *TwitchEventSub) dispatch(channel *TwitchChannel, notification func()) {
+	eventSub.Lock()
+	queue, ok := eventSub.queues[channel.id]
+	if !ok {
+		queue = make(chan func(), eventSubQueueSize)
+		eventSub.queues[channel.id] = queue
+		go func() {
+			for notification := range queue {
+				notification()
+			}
+		}()
+	}
+	eventSub.Unlock()
+
+	select {
+	case queue <- notification:
+	default:
+		log.Warn("EventSub: queue of ", channel.name, " is full, dropped notification")
+	}
+}
+
+// verifySignature checks the HMAC-SHA256 of message id, timestamp and body
+func (eventSub *TwitchEventSub) verifySignature(messageID string, timestamp string, body []byte, signature string) bool {
+	mac := hmac.New(sha256.New, []byte(eventSub.secret))
+	mac.Write([]byte(messageID))
+	mac.Write([]byte(timestamp))
+	mac.Write(body)
+
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// isDuplicate returns true if the message was received before,
+// Twitch resends messages if we do not answer fast enough
+func (eventSub *TwitchEventSub) isDuplicate(messageID string) bool {
+	eventSub.Lock()
+	defer eventSub.Unlock()
+
+	if _, ok := eventSub.messageIDs[messageID]; ok {
+		return true
+	}
+	eventSub.messageIDs[messageID] = time.Now()
+
+	return false
+}
+
+// cleanMessageIDs forgets message ids which are older than the maximum message age,
+// those messages are rejected by their timestamp anyway
+func (eventSub *TwitchEventSub) cleanMessageIDs() {
+	eventSub.Lock()
+	defer eventSub.Unlock()
+
+	for messageID, receivedAt := range eventSub.messageIDs {
+		if time.Since(receivedAt) > 2*eventSubMaxMessageAge {
+			delete(eventSub.messageIDs, messageID)
+		}
+	}
+}
+
+// syncSubscriptions removes failed subscriptions of our callback
+// and creates all missing ones for every channel
+func (eventSub *TwitchEventSub) syncSubscriptions() {
+	if !eventSub.enabled {
+		return
+	}
+
+	log.Info("EventSub: syncing subscriptions")
+
+	// key: type + channel id
+	existing := make(map[string]bool)
+
+	var cursor string
+	for {
+		requestURL := "https://api.twitch.tv/helix/eventsub/subscriptions"
+		if cursor != "" {
+			requestURL += "?after=" + url.QueryEscape(cursor)
+		}
+
+		body, err := twitch.apiRequest(eventSub.httpClient, http.MethodGet, requestURL, nil, false)
+		if err != nil {
+			log.Error("EventSub: could not get subscriptions: ", err)
+			return
+		}
+
+		var res struct {
+			Data []struct {
+				ID        string            `json:"id"`
+				Status    string            `json:"status"`
+				Type      string            `json:"type"`
+				Condition map[string]string `json:"condition"`
+				Transport struct {
+					Callback string `json:"callback"`
+				} `json:"transport"`
+			} `json:"data"`
+			Pagination struct {
+				Cursor string `json:"cursor"`
+			} `json:"pagination"`
+		}
+		err = json.Unmarshal(body, &res)
+		if err != nil {
+			log.Error("EventSub: could not unmarshal subscriptions: ", err)
+			return
+		}
+
+		for _, subscription := range res.Data {
+			if subscription.Transport.Callback != eventSub.callbackURL {
+				continue
+			}
+
+			if subscription.Status == "enabled" || subscription.Status == "webhook_callback_verification_pending" {
+				existing[subscription.Type+subscription.Condition[eventSubTypes[subscription.Type]]] = true
+				continue
+			}
+
+			log.Info("EventSub: deleting subscription ", subscription.Type, " with status ", subscription.Status)
+			_, err := twitch.apiRequest(eventSub.httpClient, http.MethodDelete, "https://api.twitch.tv/helix/eventsub/subscriptions?id="+url.QueryEscape(subscription.ID), nil, false)
+			if err != nil {
+				log.Error("EventSub: could not delete subscription: ", err)
+			}
+		}
+
+		if res.Pagination.Cursor == "" || len(res.Data) == 0 {
+			break
+		}
+		cursor = res.Pagination.Cursor
+	}
+
+	for _, channel := range twitch.channels {
+		for subscriptionType, fieldName := range eventSubTypes {
+			if existing[subscriptionType+channel.id] {
+				continue
+			}
+
+			eventSub.subscribe(channel, subscriptionType, fieldName)
+		}
+	}
+}
+
+func (eventSub *TwitchEventSub) subscribe(channel *TwitchChannel, subscriptionType string, fieldName string) {
+	log.Info("EventSub: subscribing to ", subscriptionType, " for ", channel.name)
+
+	reqBody, err := json.Marshal(map[string]interface{}{
+		"type":    subscriptionType,
+		"version": "1",
+		"condition": map[string]string{
+			fieldName: channel.id,
+		},
+		"transport": map[string]string{
+			"method":   "webhook",
+			"callback": eventSub.callbackURL,
+			"secret":   eventSub.secret,
+		},
+	})
+	if err != nil {
+		log.Error("EventSub: subscription request: ", err)
+		return
+	}
+
+	body, err := twitch.apiRequest(eventSub.httpClient, http.MethodPost, "https://api.twitch.tv/helix/eventsub/subscriptions", bytes.NewReader(reqBody), false)
+	if err != nil {
+		log.Error("EventSub: could not subscribe to ", subscriptionType, ": ", err)
+		return
+	}
+
+	var res struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &res); err == nil && res.Error != "" {
+		log.Error("EventSub: could not subscribe to ", subscriptionType, " for ", channel.name, ": ", res.Message)
+	}
+}
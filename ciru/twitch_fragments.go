@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	mentionRegexp   = regexp.MustCompile(`^@([a-zA-Z0-9_]{1,25})`)
+	cheermoteRegexp = regexp.MustCompile(`^([a-zA-Z]+)([0-9]+)$`)
+	// links at the start of a word
+	fragmentLinkRegexp = regexp.MustCompile(`^(?:` + linkRegexp.String() + `)`)
+)
+
+// messageFragments splits the content into ordered text, emote, cheermote, mention and url fragments.
+// Twitch emote ranges are inclusive offsets in unicode code points.
+// Cheermotes are only parsed in messages with bits, like Twitch does.
+func (twitch *Twitch) messageFragments(channel *TwitchChannel, content string, emotes []*TwitchEmote, bits int) []*TwitchMessageFragment {
+	runes := []rune(content)
+
+	type emoteRange struct {
+		id       string
+		from, to int
+	}
+
+	var ranges []emoteRange
+	for _, emote := range emotes {
+		for _, r := range emote.Ranges {
+			if r.From < 0 || r.To < r.From || r.To >= len(runes) {
+				continue
+			}
+			ranges = append(ranges, emoteRange{id: emote.ID, from: r.From, to: r.To + 1})
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].from < ranges[j].from
+	})
+
+	var cheermotes map[string]*TwitchCheermote
+	if channel != nil && bits > 0 {
+		cheermotes = twitch.channelCheermotes(channel)
+	}
+	emoteSets := twitch.thirdPartyEmotes(channel)
+
+	fragments := []*TwitchMessageFragment{}
+	var position int
+	for _, r := range ranges {
+		// overlapping ranges are ignored
+		if r.from < position {
+			continue
+		}
+
+		fragments = appendTextFragments(fragments, runes, position, r.from, cheermotes, emoteSets)
+		fragments = append(fragments, &TwitchMessageFragment{
+			Type: "emote",
+			Text: string(runes[r.from:r.to]),
+			From: r.from,
+			To:   r.to,
+			Emote: &TwitchFragmentEmote{
+				ID:       r.id,
+				Provider: "twitch",
+				URLs:     twitchEmoteURLs(r.id),
+			},
+		})
+		position = r.to
+	}
+
+	return appendTextFragments(fragments, runes, position, len(runes), cheermotes, emoteSets)
+}
+
+// appendTextFragments splits runes[from:to] into words and appends the third-party emotes, mentions, links
+// and cheermotes as their own fragments, everything else including the whitespace is merged into text fragments
+func appendTextFragments(fragments []*TwitchMessageFragment, runes []rune, from int, to int, cheermotes map[string]*TwitchCheermote, emoteSets []map[string]*TwitchFragmentEmote) []*TwitchMessageFragment {
+	textFrom := from
+	appendText := func(textTo int) {
+		if textTo > textFrom {
+			fragments = append(fragments, &TwitchMessageFragment{
+				Type: "text",
+				Text: string(runes[textFrom:textTo]),
+				From: textFrom,
+				To:   textTo,
+			})
+		}
+	}
+
+	for i := from; i < to; {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+
+		wordFrom := i
+		for i < to && !unicode.IsSpace(runes[i]) {
+			i++
+		}
+
+		fragment := wordFragment(string(runes[wordFrom:i]), cheermotes, emoteSets)
+		if fragment == nil {
+			continue
+		}
+
+		// the fragment can be shorter than the word, e.g. a mention followed by a comma
+		fragment.From = wordFrom
+		fragment.To = wordFrom + utf8.RuneCountInString(fragment.Text)
+
+		appendText(fragment.From)
+		fragments = append(fragments, fragment)
+		textFrom = fragment.To
+	}
+	appendText(to)
+
+	return fragments
+}
+
+// wordFragment returns the third-party emote, mention, link or cheermote at the start of the word or nil
+func wordFragment(word string, cheermotes map[string]*TwitchCheermote, emoteSets []map[string]*TwitchFragmentEmote) *TwitchMessageFragment {
+	// emote codes are case sensitive and always the whole word
+	for _, emotes := range emoteSets {
+		if emote, ok := emotes[word]; ok {
+			return &TwitchMessageFragment{
+				Type:  "emote",
+				Text:  word,
+				Emote: emote,
+			}
+		}
+	}
+
+	if match := mentionRegexp.FindStringSubmatch(word); match != nil {
+		return &TwitchMessageFragment{
+			Type:     "mention",
+			Text:     match[0],
+			Username: strings.ToLower(match[1]),
+		}
+	}
+
+	// punctuation at the end of a sentence is not part of the link
+	if match := strings.TrimRight(fragmentLinkRegexp.FindString(word), ".,!?:;"); match != "" {
+		link := match
+		if !strings.HasPrefix(strings.ToLower(link), "http://") && !strings.HasPrefix(strings.ToLower(link), "https://") {
+			link = "https://" + link
+		}
+
+		return &TwitchMessageFragment{
+			Type: "url",
+			Text: match,
+			URL:  link,
+		}
+	}
+
+	if match := cheermoteRegexp.FindStringSubmatch(word); match != nil {
+		cheermote, ok := cheermotes[strings.ToLower(match[1])]
+		bits, err := strconv.Atoi(match[2])
+		if !ok || err != nil || bits <= 0 {
+			return nil
+		}
+
+		// the tiers are sorted by their minimum bits
+		var tier *TwitchCheermoteTier
+		for i := range cheermote.Tiers {
+			if cheermote.Tiers[i].MinBits <= bits {
+				tier = &cheermote.Tiers[i]
+			}
+		}
+		if tier == nil {
+			return nil
+		}
+
+		return &TwitchMessageFragment{
+			Type: "cheermote",
+			Text: word,
+			Cheermote: &TwitchFragmentCheermote{
+				Prefix: cheermote.Prefix,
+				Bits:   bits,
+				Tier:   tier.MinBits,
+				Color:  tier.Color,
+				URLs: TwitchImageURLs{
+					X1: tier.Images.Dark.Animated["1"],
+					X2: tier.Images.Dark.Animated["2"],
+					X4: tier.Images.Dark.Animated["4"],
+				},
+			},
+		}
+	}
+
+	return nil
+}
+
+func twitchEmoteURLs(id string) TwitchImageURLs {
+	url := "https://static-cdn.jtvnw.net/emoticons/v2/" + id + "/default/dark/"
+
+	return TwitchImageURLs{
+		X1: url + "1.0",
+		X2: url + "2.0",
+		X4: url + "3.0",
+	}
+}
+
+// channelCheermotes returns the cheermotes of the channel by their lowercase prefix,
+// they are empty if Twitch is not reachable. It is called for chat messages and never
+// waits for Twitch, missing cheermotes are fetched in the background.
+func (twitch *Twitch) channelCheermotes(channel *TwitchChannel) map[string]*TwitchCheermote {
+	cheermotes, ok := twitch.cheermotes.cached(channel.id, func() (interface{}, error) {
+		return twitch.fetchCheermotes(channel)
+	})
+	if !ok {
+		return nil
+	}
+
+	return cheermotes.(map[string]*TwitchCheermote)
+}
+
+func (twitch *Twitch) fetchCheermotes(channel *TwitchChannel) (map[string]*TwitchCheermote, error) {
+	body, err := twitch.apiRequest(channel.oAuthHTTPClient, http.MethodGet, "https://api.twitch.tv/helix/bits/cheermotes?broadcaster_id="+channel.id, nil, false)
+	if err != nil {
+		log.Error("Cheermotes: ", err)
+		return nil, err
+	}
+
+	var res struct {
+		Data    []*TwitchCheermote `json:"data"`
+		Status  int                `json:"status"`
+		Message string             `json:"message"`
+	}
+
+	err = json.Unmarshal(body, &res)
+	if err == nil && res.Status != 0 && res.Status != http.StatusOK {
+		err = errors.New("twitch: " + strconv.Itoa(res.Status) + " " + res.Message)
+	}
+	if err != nil {
+		log.Error("Cheermotes: ", err)
+		return nil, err
+	}
+
+	cheermotes := make(map[string]*TwitchCheermote)
+	for _, cheermote := range res.Data {
+		sort.Slice(cheermote.Tiers, func(i, j int) bool {
+			return cheermote.Tiers[i].MinBits < cheermote.Tiers[j].MinBits
+		})
+		cheermotes[strings.ToLower(cheermote.Prefix)] = cheermote
+	}
+
+	return cheermotes, nil
+}
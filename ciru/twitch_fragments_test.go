@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestMessageFragments(t *testing.T) {
+	channel := &TwitchChannel{name: "channel", id: "123"}
+	twitch := &Twitch{
+		cheermotes: newCache("test_cheermotes", 0, time.Hour, 0, nil),
+	}
+	twitch.cheermotes.set(channel.id, map[string]*TwitchCheermote{
+		"cheer": {
+			Prefix: "Cheer",
+			Tiers: []TwitchCheermoteTier{
+				{MinBits: 1, Color: "#979797"},
+				{MinBits: 100, Color: "#9c3ee8"},
+			},
+		},
+	})
+
+	tests := []struct {
+		name    string
+		content string
+		emotes  string
+		bits    int
+		want    []TwitchMessageFragment
+	}{
+		{
+			name:    "emoji before emote",
+			content: "😀 Kappa",
+			emotes:  `[{"id":"25","ranges":[{"from":2,"to":6}]}]`,
+			want: []TwitchMessageFragment{
+				{Type: "text", Text: "😀 ", From: 0, To: 2},
+				{Type: "emote", Text: "Kappa", From: 2, To: 7},
+			},
+		},
+		{
+			name:    "overlapping ranges",
+			content: "Kappa Keepo",
+			emotes:  `[{"id":"25","ranges":[{"from":0,"to":4}]},{"id":"1902","ranges":[{"from":3,"to":8},{"from":6,"to":10}]}]`,
+			want: []TwitchMessageFragment{
+				{Type: "emote", Text: "Kappa", From: 0, To: 5},
+				{Type: "text", Text: " ", From: 5, To: 6},
+				{Type: "emote", Text: "Keepo", From: 6, To: 11},
+			},
+		},
+		{
+			name:    "range out of the content",
+			content: "Kappa",
+			emotes:  `[{"id":"25","ranges":[{"from":0,"to":5}]}]`,
+			want: []TwitchMessageFragment{
+				{Type: "text", Text: "Kappa", From: 0, To: 5},
+			},
+		},
+		{
+			name:    "mention followed by a comma",
+			content: "@User, hi",
+			want: []TwitchMessageFragment{
+				{Type: "mention", Text: "@User", From: 0, To: 5, Username: "user"},
+				{Type: "text", Text: ", hi", From: 5, To: 9},
+			},
+		},
+		{
+			name:    "link at the end of a sentence",
+			content: "see example.com/x.",
+			want: []TwitchMessageFragment{
+				{Type: "text", Text: "see ", From: 0, To: 4},
+				{Type: "url", Text: "example.com/x", From: 4, To: 17, URL: "https://example.com/x"},
+				{Type: "text", Text: ".", From: 17, To: 18},
+			},
+		},
+		{
+			name:    "cheermote with bits",
+			content: "Cheer100 hi",
+			bits:    100,
+			want: []TwitchMessageFragment{
+				{Type: "cheermote", Text: "Cheer100", From: 0, To: 8, Cheermote: &TwitchFragmentCheermote{Prefix: "Cheer", Bits: 100, Tier: 100, Color: "#9c3ee8"}},
+				{Type: "text", Text: " hi", From: 8, To: 11},
+			},
+		},
+		{
+			name:    "cheermote below the second tier",
+			content: "cheer99",
+			bits:    99,
+			want: []TwitchMessageFragment{
+				{Type: "cheermote", Text: "cheer99", From: 0, To: 7, Cheermote: &TwitchFragmentCheermote{Prefix: "Cheer", Bits: 99, Tier: 1, Color: "#979797"}},
+			},
+		},
+		{
+			name:    "cheermote without bits",
+			content: "Cheer100 hi",
+			want: []TwitchMessageFragment{
+				{Type: "text", Text: "Cheer100 hi", From: 0, To: 11},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		var emotes []*TwitchEmote
+		if test.emotes != "" {
+			if err := json.Unmarshal([]byte(test.emotes), &emotes); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+
+		fragments := twitch.messageFragments(channel, test.content, emotes, test.bits)
+		if len(fragments) != len(test.want) {
+			t.Errorf("%s: got %d fragments, want %d", test.name, len(fragments), len(test.want))
+			continue
+		}
+
+		for i, fragment := range fragments {
+			want := test.want[i]
+			if fragment.Type != want.Type || fragment.Text != want.Text || fragment.From != want.From || fragment.To != want.To ||
+				fragment.Username != want.Username || fragment.URL != want.URL {
+				t.Errorf("%s: fragment %d is %+v, want %+v", test.name, i, fragment, want)
+			}
+
+			if want.Cheermote == nil {
+				continue
+			}
+			if c := fragment.Cheermote; c == nil || c.Prefix != want.Cheermote.Prefix || c.Bits != want.Cheermote.Bits ||
+				c.Tier != want.Cheermote.Tier || c.Color != want.Cheermote.Color {
+				t.Errorf("%s: cheermote %d is %+v, want %+v", test.name, i, c, want.Cheermote)
+			}
+		}
+	}
+}
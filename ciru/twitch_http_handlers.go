@@ -3,42 +3,205 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"html/template"
 	"net/http"
-	"time"
+	"strings"
 )
 
 func (twitch *Twitch) loginHandler(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, twitch.oauthConfig.AuthCodeURL("12345"), http.StatusTemporaryRedirect)
+	channel := twitch.channelFromRequest(r)
+	if channel == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	state, err := twitch.newOAuthState(channel)
+	if err != nil {
+		log.Error("Could not create oauth state: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, twitch.oauthConfig.AuthCodeURL(state), http.StatusTemporaryRedirect)
 }
 
 func (twitch *Twitch) returnHandler(w http.ResponseWriter, r *http.Request) {
-	var err error
-	twitch.oauthToken, err = twitch.oauthConfig.Exchange(context.Background(), r.URL.Query().Get("code"))
+	query := r.URL.Query()
+	channel, ok := twitch.verifyOAuthState(query.Get("state"))
+	if !ok {
+		log.Error("OAuth return with invalid state")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if query.Get("error") != "" {
+		log.Error("OAuth login failed: ", query.Get("error"), " - ", query.Get("error_description"))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	token, err := twitch.oauthConfig.Exchange(context.Background(), query.Get("code"))
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// PubSub topics of a channel can only be read with the token of its broadcaster
+	validation, err := twitch.validateOAuthToken(token.AccessToken)
 	if err != nil {
 		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if validation.UserID != channel.id {
+		log.Error("OAuth login for ", channel.name, " by another user: ", validation.Login)
+		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
-	cron.Stop("refresh_oauth_token")
-	cron.New("refresh_oauth_token", twitch.refreshAccessToken, 3000*time.Second)
+	channel.tokenSource.set(token)
+
+	http.Redirect(w, r, "/status", http.StatusSeeOther)
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><title>ciru status</title></head>
+<body>
+<h1>ciru status</h1>
+{{range .}}
+<h2>{{.Name}}</h2>
+{{if .Validation}}
+<table>
+<tr><th>Owner</th><td>{{.Validation.Login}} ({{.Validation.UserID}}){{if not .IsBroadcaster}} &ndash; not the broadcaster of this channel{{end}}</td></tr>
+<tr><th>Scopes</th><td>{{range .Validation.Scopes}}{{.}} {{end}}</td></tr>
+<tr><th>Missing scopes</th><td>{{range .MissingScopes}}{{.}} {{else}}none{{end}}</td></tr>
+<tr><th>Expires at</th><td>{{.Validation.ExpiresAt.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+</table>
+{{else}}
+<p>Not logged in{{if .Error}}: {{.Error}}{{end}}</p>
+{{end}}
+<p><a href="/login?channel={{.Name}}">Login with Twitch</a></p>
+{{end}}
+</body>
+</html>
+`))
+
+func (twitch *Twitch) statusHandler(w http.ResponseWriter, r *http.Request) {
+	type channelStatus struct {
+		Name          string
+		Validation    *TwitchTokenValidation
+		MissingScopes []string
+		IsBroadcaster bool
+		Error         error
+	}
+
+	var data []channelStatus
+	for _, name := range twitch.channelNames {
+		channel := twitch.channels[name]
+		status := channelStatus{Name: channel.name}
+
+		token, err := channel.tokenSource.Token()
+		if err == nil {
+			status.Validation, status.Error = twitch.validateOAuthToken(token.AccessToken)
+		} else if err != errNoToken {
+			status.Error = err
+		}
+
+		if status.Validation != nil {
+			status.IsBroadcaster = status.Validation.UserID == channel.id
+
+			scopes := make(map[string]bool)
+			for _, scope := range status.Validation.Scopes {
+				scopes[scope] = true
+			}
+			for _, scope := range twitch.oauthConfig.Scopes {
+				if !scopes[scope] {
+					status.MissingScopes = append(status.MissingScopes, scope)
+				}
+			}
+		}
+
+		data = append(data, status)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, data); err != nil {
+		log.Error("Status page: ", err)
+	}
 }
 
 func (twitch *Twitch) subcountHandler(w http.ResponseWriter, r *http.Request) {
-	subCount, err := twitch.getBroadcasterSubscriptions()
+	channel := twitch.channelFromRequest(r)
+	if channel == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	subscriptions, err := twitch.getSubscriptions(channel)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
 	res := struct {
-		SubCount int   `json:"subcount"`
-		Error    error `json:"error"`
+		SubCount int `json:"subcount"`
+		TwitchSubscriptions
 	}{
-		SubCount: subCount,
-		Error:    err,
+		SubCount:            subscriptions.Total,
+		TwitchSubscriptions: *subscriptions,
 	}
 
 	resBody, err := json.Marshal(res)
-	if err != nil || res.Error != nil {
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resBody)
+}
+
+// moderationHandler executes the moderation action in the json body,
+// moderators authenticate with "Authorization: Bearer {token}"
+func (twitch *Twitch) moderationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	moderator := twitch.moderation.authenticateModerator(strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer")))
+	if moderator == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var action TwitchModerationAction
+	err := json.NewDecoder(r.Body).Decode(&action)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	result, err := twitch.executeModerationAction(moderator, action)
+	status := http.StatusOK
+	switch err {
+	case nil:
+	case errModerationInvalidAction:
+		status = http.StatusBadRequest
+	case errModerationUnknownUser:
+		status = http.StatusNotFound
+	default:
+		status = http.StatusBadGateway
+	}
+
+	resBody, err := json.Marshal(result)
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusNotImplemented)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	w.Write(resBody)
 }
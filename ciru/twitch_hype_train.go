@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// eventHypeTrain handles channel.hype_train.begin, channel.hype_train.progress and channel.hype_train.end
+func (twitch *Twitch) eventHypeTrain(stage string) func(channel *TwitchChannel, event json.RawMessage) {
+	return func(channel *TwitchChannel, event json.RawMessage) {
+		type contribution struct {
+			UserID    string `json:"user_id"`
+			UserLogin string `json:"user_login"`
+			UserName  string `json:"user_name"`
+			Type      string `json:"type"`
+			Total     int    `json:"total"`
+		}
+		var e struct {
+			ID               string         `json:"id"`
+			Level            int            `json:"level"`
+			Total            int            `json:"total"`
+			Progress         int            `json:"progress"`
+			Goal             int            `json:"goal"`
+			TopContributions []contribution `json:"top_contributions"`
+			LastContribution *contribution  `json:"last_contribution"`
+			StartedAt        time.Time      `json:"started_at"`
+			ExpiresAt        time.Time      `json:"expires_at"`
+			EndedAt          time.Time      `json:"ended_at"`
+			CooldownEndsAt   time.Time      `json:"cooldown_ends_at"`
+		}
+		err := json.Unmarshal(event, &e)
+		if err != nil {
+			log.Error("Hype train: could not unmarshal event: ", err)
+			return
+		}
+
+		channel.Lock()
+		hypeTrain := channel.hypeTrain
+		newHypeTrain := hypeTrain == nil || hypeTrain.ID != e.ID
+		if newHypeTrain {
+			hypeTrain = &TwitchHypeTrain{
+				ID:           e.ID,
+				contributors: make(map[string]*TwitchHypeTrainContributor),
+			}
+			channel.hypeTrain = hypeTrain
+		}
+
+		hypeTrain.Stage = stage
+		hypeTrain.Level = e.Level
+		hypeTrain.Total = e.Total
+		hypeTrain.Progress = e.Progress
+		hypeTrain.Goal = e.Goal
+		hypeTrain.StartedAt = e.StartedAt
+		hypeTrain.ExpiresAt = e.ExpiresAt
+		hypeTrain.EndedAt = e.EndedAt
+		hypeTrain.CooldownEndsAt = e.CooldownEndsAt
+
+		hypeTrain.TopContributions = nil
+		for _, c := range e.TopContributions {
+			hypeTrain.TopContributions = append(hypeTrain.TopContributions, TwitchHypeTrainContribution{
+				UserID:      c.UserID,
+				Username:    c.UserLogin,
+				DisplayName: c.UserName,
+				Type:        c.Type,
+				Total:       c.Total,
+			})
+		}
+
+		// Twitch only reports the top contributions, all other contributors
+		// are collected from the last contribution of every progress event
+		if e.LastContribution != nil {
+			hypeTrain.addContribution(e.LastContribution.UserID, e.LastContribution.UserLogin, e.LastContribution.Type, e.LastContribution.Total)
+		}
+		for _, c := range e.TopContributions {
+			hypeTrain.ensureContribution(c.UserID, c.UserLogin, c.Type, c.Total)
+		}
+
+		if stage == "end" {
+			channel.hypeTrain = nil
+		}
+		hypeTrain.updateSecondsLeft()
+		h := *hypeTrain
+		channel.Unlock()
+
+		hugo.hub.broadcast(channel.name, h)
+
+		// the countdown is also started if ciru missed the begin event
+		if newHypeTrain && stage != "end" {
+			go twitch.hypeTrainCountdown(channel, h.ID)
+		}
+
+		if stage == "end" {
+			contributors := make([]*TwitchHypeTrainContributor, 0, len(h.contributors))
+			for _, c := range h.contributors {
+				contributors = append(contributors, c)
+			}
+			sort.Slice(contributors, func(i, j int) bool {
+				return contributors[i].Bits+contributors[i].Subscriptions > contributors[j].Bits+contributors[j].Subscriptions
+			})
+
+			err := steveRequest(http.MethodPost, "/hype_train", map[string]interface{}{
+				"id":           h.ID,
+				"channel":      channel.name,
+				"level":        h.Level,
+				"total":        h.Total,
+				"startedAt":    h.StartedAt,
+				"endedAt":      h.EndedAt,
+				"contributors": contributors,
+			}, nil)
+			if err != nil {
+				log.Error("Hype train: could not record hype train: ", err)
+			}
+		}
+	}
+}
+
+// hypeTrainCountdown broadcasts the remaining time of the hype train every second until it ends
+func (twitch *Twitch) hypeTrainCountdown(channel *TwitchChannel, id string) {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+
+	for range t.C {
+		channel.Lock()
+		hypeTrain := channel.hypeTrain
+		if hypeTrain == nil || hypeTrain.ID != id {
+			channel.Unlock()
+			return
+		}
+		hypeTrain.updateSecondsLeft()
+		h := *hypeTrain
+		h.Stage = "countdown"
+		channel.Unlock()
+
+		hugo.hub.broadcast(channel.name, h)
+
+		if h.SecondsLeft == 0 {
+			return
+		}
+	}
+}
+
+func (hypeTrain *TwitchHypeTrain) updateSecondsLeft() {
+	hypeTrain.SecondsLeft = 0
+	if hypeTrain.Stage != "end" && hypeTrain.ExpiresAt.After(time.Now()) {
+		hypeTrain.SecondsLeft = int(time.Until(hypeTrain.ExpiresAt).Seconds())
+	}
+}
+
+func (hypeTrain *TwitchHypeTrain) contributor(userID string, username string) *TwitchHypeTrainContributor {
+	username = strings.ToLower(username)
+	c, ok := hypeTrain.contributors[username]
+	if !ok {
+		c = &TwitchHypeTrainContributor{
+			UserID:   userID,
+			Username: username,
+		}
+		hypeTrain.contributors[username] = c
+	}
+
+	return c
+}
+
+func (hypeTrain *TwitchHypeTrain) addContribution(userID string, username string, contributionType string, total int) {
+	c := hypeTrain.contributor(userID, username)
+	if contributionType == "bits" {
+		c.Bits += total
+	} else {
+		c.Subscriptions += total
+	}
+}
+
+// ensureContribution raises the contribution of the user to at least total,
+// top contributions are the sum of all contributions of that type
+func (hypeTrain *TwitchHypeTrain) ensureContribution(userID string, username string, contributionType string, total int) {
+	c := hypeTrain.contributor(userID, username)
+	if contributionType == "bits" && c.Bits < total {
+		c.Bits = total
+	} else if contributionType != "bits" && c.Subscriptions < total {
+		c.Subscriptions = total
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+var linkRegexp = regexp.MustCompile(`(?i)\b((https?://)?([a-z0-9-]+\.)+[a-z]{2,}(/\S*)?)`)
+
+func newTwitchModeration() *TwitchModeration {
+	moderation := &TwitchModeration{
+		RWMutex:        &sync.RWMutex{},
+		recentMessages: make(map[string][]TwitchRecentMessage),
+		moderators:     loadModerators(),
+	}
+	moderation.loadConfig()
+
+	return moderation
+}
+
+// loadConfig reads the filter chain from the json file MODERATION_CONFIG,
+// the old config is kept if the file is invalid
+func (moderation *TwitchModeration) loadConfig() {
+	path := os.Getenv("MODERATION_CONFIG")
+	if path == "" {
+		return
+	}
+
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Error("Moderation: could not read config: ", err)
+		return
+	}
+
+	var config TwitchModerationConfig
+	err = json.Unmarshal(body, &config)
+	if err != nil {
+		log.Error("Moderation: could not unmarshal config: ", err)
+		return
+	}
+
+	// invalid rules are skipped, with missing parameters they would match every message
+	var rules []*TwitchModerationRule
+	for _, rule := range config.Rules {
+		if err := rule.compile(); err != nil {
+			log.Error("Moderation: skipping rule ", rule.Name, ": ", err)
+			continue
+		}
+
+		if rule.Exempt == nil {
+			rule.Exempt = config.Exempt
+		}
+		rules = append(rules, rule)
+	}
+
+	log.Info("Moderation: loaded ", len(rules), " of ", len(config.Rules), " rules")
+	moderation.Lock()
+	moderation.rules = rules
+	moderation.Unlock()
+}
+
+// compile validates the parameters of the rule and prepares its patterns and window
+func (rule *TwitchModerationRule) compile() error {
+	switch rule.Action {
+	case "delete", "ban", "warn":
+	case "timeout":
+		if rule.Duration < 1 || rule.Duration > 1209600 {
+			return errors.New("duration must be between 1 and 1209600 seconds")
+		}
+	default:
+		return errors.New("unknown action " + rule.Action)
+	}
+
+	switch rule.Type {
+	case "banned_words":
+		if len(rule.Words) == 0 {
+			return errors.New("words are missing")
+		}
+	case "regex":
+		if len(rule.Patterns) == 0 {
+			return errors.New("patterns are missing")
+		}
+	case "links":
+	case "caps", "symbols":
+		if rule.MaxRatio <= 0 || rule.MaxRatio >= 1 || rule.MinLength < 0 {
+			return errors.New("maxRatio must be between 0 and 1 and minLength must not be negative")
+		}
+	case "emotes":
+		if rule.MaxEmotes < 1 {
+			return errors.New("maxEmotes must be at least 1")
+		}
+	case "repeat":
+		if rule.MaxRepeats < 1 {
+			return errors.New("maxRepeats must be at least 1")
+		}
+		window, err := time.ParseDuration(rule.Window)
+		if err != nil || window <= 0 {
+			return errors.New("invalid window " + rule.Window)
+		}
+		rule.window = window
+	case "zalgo":
+		if rule.MaxCombining < 1 {
+			return errors.New("maxCombining must be at least 1")
+		}
+	default:
+		return errors.New("unknown type " + rule.Type)
+	}
+
+	rule.regexps = nil
+	for _, pattern := range rule.Patterns {
+		r, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		rule.regexps = append(rule.regexps, r)
+	}
+	for _, word := range rule.Words {
+		rule.regexps = append(rule.regexps, regexp.MustCompile(`(?i)\b`+regexp.QuoteMeta(word)+`\b`))
+	}
+
+	return nil
+}
+
+// check runs the message through the filter chain and executes the action of the
+// first rule that matches. It returns false if the message must not be shown.
+func (moderation *TwitchModeration) check(channel *TwitchChannel, m *TwitchMessage, emoteCount int) bool {
+	moderation.RLock()
+	rules := moderation.rules
+	moderation.RUnlock()
+
+	if len(rules) == 0 {
+		return true
+	}
+
+	roles := map[string]bool{
+		"broadcaster": m.User.IsBroadcaster,
+		"mod":         m.User.IsMod,
+		"vip":         m.User.IsVIP,
+		"subscriber":  m.User.IsSubscriber,
+		"founder":     m.User.IsFounder,
+		"partner":     m.User.IsPartner,
+	}
+
+	repeats := moderation.trackMessage(channel, m)
+
+	for _, rule := range rules {
+		if rule.isExempt(roles) || !rule.matches(m.Content, emoteCount, repeats) {
+			continue
+		}
+
+		log.Info("Moderation: rule ", rule.Name, " matched message ", m.ID, " of ", m.User.Username)
+		moderation.execute(channel, rule, m)
+
+		return rule.Action == "warn"
+	}
+
+	return true
+}
+
+// trackMessage remembers the message of the user and returns how often
+// the user sent the same message within the longest repeat window
+func (moderation *TwitchModeration) trackMessage(channel *TwitchChannel, m *TwitchMessage) int {
+	moderation.RLock()
+	var window time.Duration
+	for _, rule := range moderation.rules {
+		if rule.Type == "repeat" && rule.window > window {
+			window = rule.window
+		}
+	}
+	moderation.RUnlock()
+
+	if window == 0 {
+		return 0
+	}
+
+	key := channel.name + ":" + m.User.Username
+	content := strings.ToLower(strings.Join(strings.Fields(m.Content), " "))
+
+	moderation.Lock()
+	defer moderation.Unlock()
+
+	var repeats int
+	recentMessages := moderation.recentMessages[key][:0]
+	for _, recent := range moderation.recentMessages[key] {
+		if time.Since(recent.receivedAt) > window {
+			continue
+		}
+		recentMessages = append(recentMessages, recent)
+		if recent.content == content {
+			repeats++
+		}
+	}
+	moderation.recentMessages[key] = append(recentMessages, TwitchRecentMessage{
+		content:    content,
+		receivedAt: time.Now(),
+	})
+
+	return repeats
+}
+
+// cleanRecentMessages forgets users who did not write within the last hour
+func (moderation *TwitchModeration) cleanRecentMessages() {
+	moderation.Lock()
+	defer moderation.Unlock()
+
+	for key, recentMessages := range moderation.recentMessages {
+		if len(recentMessages) == 0 || time.Since(recentMessages[len(recentMessages)-1].receivedAt) > time.Hour {
+			delete(moderation.recentMessages, key)
+		}
+	}
+}
+
+func (moderation *TwitchModeration) execute(channel *TwitchChannel, rule *TwitchModerationRule, m *TwitchMessage) {
+	reason := rule.Reason
+	if reason == "" {
+		reason = rule.Name
+	}
+
+	switch rule.Action {
+	case "delete":
+		twitch.say(channel, "/delete "+m.ID, chatPriorityModeration)
+	case "timeout":
+		twitch.say(channel, "/timeout "+m.User.Username+" "+strconv.Itoa(rule.Duration)+" "+reason, chatPriorityModeration)
+	case "ban":
+		twitch.say(channel, "/ban "+m.User.Username+" "+reason, chatPriorityModeration)
+	case "warn":
+		twitch.say(channel, "@"+m.User.DisplayName+" "+reason, chatPriorityModeration)
+	default:
+		log.Error("Moderation: unknown action ", rule.Action, " in rule ", rule.Name)
+		return
+	}
+
+	hugo.hub.broadcast(channel.name, TwitchModerationEvent{
+		Action:   rule.Action,
+		Rule:     rule.Name,
+		Username: m.User.Username,
+		UserID:   m.User.ID,
+		MsgID:    m.ID,
+		Content:  m.Content,
+		Duration: rule.Duration,
+		Reason:   reason,
+	})
+}
+
+func (rule *TwitchModerationRule) isExempt(roles map[string]bool) bool {
+	for _, role := range rule.Exempt {
+		if roles[role] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (rule *TwitchModerationRule) matches(content string, emoteCount int, repeats int) bool {
+	switch rule.Type {
+	case "banned_words", "regex":
+		for _, r := range rule.regexps {
+			if r.MatchString(content) {
+				return true
+			}
+		}
+
+	case "links":
+		for _, link := range linkRegexp.FindAllString(content, -1) {
+			if !rule.isAllowedLink(link) {
+				return true
+			}
+		}
+
+	case "caps":
+		var letters, upper int
+		for _, r := range content {
+			if unicode.IsLetter(r) {
+				letters++
+				if unicode.IsUpper(r) {
+					upper++
+				}
+			}
+		}
+		return letters >= rule.MinLength && letters > 0 && float64(upper)/float64(letters) > rule.MaxRatio
+
+	case "symbols":
+		var characters, symbols int
+		for _, r := range content {
+			if unicode.IsSpace(r) {
+				continue
+			}
+			characters++
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+				symbols++
+			}
+		}
+		return characters >= rule.MinLength && characters > 0 && float64(symbols)/float64(characters) > rule.MaxRatio
+
+	case "emotes":
+		return emoteCount > rule.MaxEmotes
+
+	case "repeat":
+		return repeats >= rule.MaxRepeats
+
+	case "zalgo":
+		// zalgo text stacks combining marks on top of each other
+		var combining int
+		for _, r := range content {
+			if unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Me, r) {
+				combining++
+				if combining > rule.MaxCombining {
+					return true
+				}
+			} else {
+				combining = 0
+			}
+		}
+	}
+
+	return false
+}
+
+// isAllowedLink returns true if the host of the link is one of the allowed domains or a subdomain of them
+func (rule *TwitchModerationRule) isAllowedLink(link string) bool {
+	if !strings.Contains(link, "://") {
+		link = "http://" + link
+	}
+
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+
+	for _, domain := range rule.Allow {
+		domain = strings.ToLower(domain)
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
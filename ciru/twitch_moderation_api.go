@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errModerationInvalidAction = errors.New("moderation: invalid action")
+	errModerationUnknownUser   = errors.New("moderation: unknown user")
+)
+
+// moderationChatModes are the chat settings which can be toggled, the keys match RAID_PROTECTION_MODES
+var moderationChatModes = map[string]string{
+	"slow":      "slow_mode",
+	"followers": "follower_mode",
+	"emoteonly": "emote_mode",
+	"subonly":   "subscriber_mode",
+}
+
+// loadModerators reads MODERATION_API_TOKENS, a comma separated list of moderator:token
+func loadModerators() map[string]string {
+	moderators := make(map[string]string)
+	for _, entry := range strings.Split(os.Getenv("MODERATION_API_TOKENS"), ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			continue
+		}
+
+		moderators[parts[1]] = strings.ToLower(parts[0])
+	}
+
+	return moderators
+}
+
+// authenticateModerator returns the moderator of the api token or an empty string if the token is invalid
+func (moderation *TwitchModeration) authenticateModerator(token string) string {
+	if token == "" {
+		return ""
+	}
+
+	moderator := ""
+	for t, name := range moderation.moderators {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			moderator = name
+		}
+	}
+
+	return moderator
+}
+
+// validateModerationAction returns errModerationInvalidAction if parameters of the action are missing or out of range
+func validateModerationAction(action TwitchModerationAction) error {
+	valid := false
+	switch action.Action {
+	case "timeout":
+		valid = action.Username != "" && action.Duration >= 1 && action.Duration <= 1209600
+	case "ban", "unban":
+		valid = action.Username != ""
+	case "delete":
+		valid = action.MsgID != ""
+	case "clear":
+		valid = true
+	case "slow":
+		valid = !action.Enabled || (action.Duration >= 3 && action.Duration <= 120)
+	case "followers":
+		valid = action.Duration >= 0 && action.Duration <= 129600
+	case "emoteonly", "subonly":
+		valid = true
+	case "announcement":
+		valid = action.Message != "" && len([]rune(action.Message)) <= chatMessageMaxLength
+	}
+
+	if !valid || len([]rune(action.Reason)) > chatMessageMaxLength {
+		return errModerationInvalidAction
+	}
+
+	return nil
+}
+
+// executeModerationAction runs the action via the Helix moderation endpoints with the token
+// of the broadcaster and logs it with the moderator to the data service
+func (twitch *Twitch) executeModerationAction(moderator string, action TwitchModerationAction) (TwitchModerationActionResult, error) {
+	result := TwitchModerationActionResult{
+		Action:     action,
+		Moderator:  moderator,
+		ExecutedAt: time.Now(),
+	}
+
+	channel := twitch.defaultChannel()
+	if action.Channel != "" {
+		channel = twitch.channel(action.Channel)
+	}
+
+	err := validateModerationAction(action)
+	if err == nil && channel == nil {
+		err = errModerationInvalidAction
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result, err
+	}
+	result.Action.Channel = channel.name
+
+	err = twitch.requestModerationAction(channel, action)
+	if err != nil {
+		log.Error("Moderation: ", action.Action, " by ", moderator, " in ", channel.name, ": ", err)
+		result.Error = err.Error()
+	} else {
+		log.Info("Moderation: ", action.Action, " by ", moderator, " in ", channel.name)
+		result.Success = true
+	}
+
+	go twitch.logModerationAction(result)
+
+	return result, err
+}
+
+func (twitch *Twitch) requestModerationAction(channel *TwitchChannel, action TwitchModerationAction) error {
+	query := url.Values{}
+	var body interface{}
+	method := http.MethodPost
+	path := ""
+
+	switch action.Action {
+	case "timeout", "ban", "unban":
+		user, err := twitch.getUser(action.Username)
+		if err == errUserNotFound {
+			return errModerationUnknownUser
+		} else if err != nil {
+			return err
+		}
+
+		path = "/moderation/bans"
+		if action.Action == "unban" {
+			method = http.MethodDelete
+			query.Set("user_id", user.ID)
+			break
+		}
+
+		ban := map[string]interface{}{
+			"user_id": user.ID,
+			"reason":  action.Reason,
+		}
+		if action.Action == "timeout" {
+			ban["duration"] = action.Duration
+		}
+		body = map[string]interface{}{"data": ban}
+	case "delete", "clear":
+		path = "/moderation/chat"
+		method = http.MethodDelete
+		if action.Action == "delete" {
+			query.Set("message_id", action.MsgID)
+		}
+	case "slow", "followers", "emoteonly", "subonly":
+		path = "/chat/settings"
+		method = http.MethodPatch
+
+		setting := moderationChatModes[action.Action]
+		settings := map[string]interface{}{setting: action.Enabled}
+		if action.Enabled && action.Action == "slow" {
+			settings["slow_mode_wait_time"] = action.Duration
+		} else if action.Enabled && action.Action == "followers" {
+			settings["follower_mode_duration"] = action.Duration
+		}
+		body = settings
+	case "announcement":
+		path = "/chat/announcements"
+
+		announcement := map[string]interface{}{"message": action.Message}
+		if action.Color != "" {
+			announcement["color"] = strings.ToLower(action.Color)
+		}
+		body = announcement
+	default:
+		return errModerationInvalidAction
+	}
+
+	// the broadcaster acts as moderator because ciru only has their token
+	query.Set("broadcaster_id", channel.id)
+	query.Set("moderator_id", channel.id)
+
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	resBody, err := twitch.apiRequest(channel.oAuthHTTPClient, method, "https://api.twitch.tv/helix"+path+"?"+query.Encode(), reqBody, false)
+	if err != nil {
+		return err
+	}
+
+	// successful requests return no content or the changed data
+	if len(resBody) == 0 {
+		return nil
+	}
+
+	var res struct {
+		Status  int    `json:"status"`
+		Message string `json:"message"`
+	}
+	err = json.Unmarshal(resBody, &res)
+	if err == nil && res.Status > 299 {
+		err = errors.New("twitch: " + strconv.Itoa(res.Status) + " " + res.Message)
+	}
+
+	return err
+}
+
+// logModerationAction stores the action with its moderator in the data service
+func (twitch *Twitch) logModerationAction(result TwitchModerationActionResult) {
+	err := steveRequest(http.MethodPost, "/moderation/actions", map[string]interface{}{
+		"channel":    result.Action.Channel,
+		"moderator":  result.Moderator,
+		"action":     result.Action.Action,
+		"username":   strings.ToLower(result.Action.Username),
+		"messageID":  result.Action.MsgID,
+		"duration":   result.Action.Duration,
+		"enabled":    result.Action.Enabled,
+		"reason":     result.Action.Reason,
+		"message":    result.Action.Message,
+		"success":    result.Success,
+		"error":      result.Error,
+		"executedAt": result.ExecutedAt,
+	}, nil)
+	if err != nil {
+		log.Error("Moderation log: ", err)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// moderator actions are kept this long to enrich clearchat and clearmsg events
+	moderatorActionTTL = time.Minute
+	// messages of a user which are sent with a clearchat
+	clearchatMessages = 10
+	// older messages of the user are not shown in chat anymore
+	clearchatMessagesMaxAge = 10 * time.Minute
+)
+
+// eventModeratorAction broadcasts the action of a moderator from PubSub as moderation event
+// and keeps it for the clearchat or clearmsg which Twitch sends via IRC
+func (twitch *Twitch) eventModeratorAction(channel *TwitchChannel, m TwitchPubSubMessageModeratorAction) {
+	if m.Data.ModerationAction == "" {
+		// e.g. moderator_added or automod events
+		return
+	}
+
+	event := TwitchModerationEvent{
+		Action:      m.Data.ModerationAction,
+		Username:    strings.ToLower(m.Data.TargetUserLogin),
+		UserID:      m.Data.TargetUserID,
+		MsgID:       m.Data.MsgID,
+		Moderator:   strings.ToLower(m.Data.CreatedBy),
+		ModeratorID: m.Data.CreatedByUserID,
+		FromAutomod: m.Data.FromAutomod,
+	}
+
+	arg := func(i int) string {
+		if i < len(m.Data.Args) {
+			return m.Data.Args[i]
+		}
+		return ""
+	}
+	// the reason can contain spaces
+	argsFrom := func(i int) string {
+		if i < len(m.Data.Args) {
+			return strings.Join(m.Data.Args[i:], " ")
+		}
+		return ""
+	}
+
+	key := ""
+	switch event.Action {
+	case "timeout":
+		event.Duration, _ = strconv.Atoi(arg(1))
+		event.Reason = argsFrom(2)
+		key = "user:" + strings.ToLower(arg(0))
+	case "ban":
+		event.Reason = argsFrom(1)
+		key = "user:" + strings.ToLower(arg(0))
+	case "delete":
+		event.Content = arg(1)
+		event.MsgID = arg(2)
+		key = "msg:" + event.MsgID
+	case "clear":
+		key = "user:"
+	case "slow", "followers":
+		event.Duration, _ = strconv.Atoi(arg(0))
+	}
+	if event.Username == "" && event.Action != "clear" {
+		event.Username = strings.ToLower(arg(0))
+	}
+
+	if key != "" {
+		channel.Lock()
+		for k, action := range channel.moderatorActions {
+			if time.Since(action.receivedAt) > moderatorActionTTL {
+				delete(channel.moderatorActions, k)
+			}
+		}
+		channel.moderatorActions[key] = TwitchModeratorAction{
+			event:      event,
+			receivedAt: time.Now(),
+		}
+		if waiter, ok := channel.moderatorActionWaiters[key]; ok {
+			close(waiter)
+			delete(channel.moderatorActionWaiters, key)
+		}
+		channel.Unlock()
+	}
+
+	// actions of the filter were already broadcasted with their rule
+	if event.Moderator == strings.ToLower(os.Getenv("TWITCH_USERNAME")) {
+		return
+	}
+
+	log.Info("Moderation: ", event.Action, " by ", event.Moderator, " in ", channel.name)
+
+	// the chat log must not block the other PubSub topics of the channel
+	go func() {
+		if event.Action == "delete" && event.Content == "" {
+			if messages, err := twitch.chatLogMessages(url.Values{"id": {event.MsgID}}); err == nil && len(messages) > 0 {
+				event.Content = messages[0].Content
+			}
+		}
+
+		hugo.hub.broadcast(channel.name, event)
+	}()
+}
+
+// moderatorAction returns the recent action of a moderator and waits up to MODERATOR_ACTION_WAIT
+// for it because Twitch sends PubSub and IRC independently, nil if there is none.
+// It does not wait if PubSub does not listen to the moderator actions of the channel.
+func (channel *TwitchChannel) moderatorAction(key string) *TwitchModerationEvent {
+	channel.Lock()
+	action, ok := channel.moderatorActions[key]
+	if ok && time.Since(action.receivedAt) <= moderatorActionTTL {
+		channel.Unlock()
+		return &action.event
+	}
+	if !channel.moderatorActionsListening {
+		channel.Unlock()
+		return nil
+	}
+
+	waiter, ok := channel.moderatorActionWaiters[key]
+	if !ok {
+		waiter = make(chan bool)
+		channel.moderatorActionWaiters[key] = waiter
+	}
+	channel.Unlock()
+
+	timer := time.NewTimer(envDuration("MODERATOR_ACTION_WAIT", 500*time.Millisecond))
+	defer timer.Stop()
+
+	select {
+	case <-waiter:
+	case <-timer.C:
+	}
+
+	channel.Lock()
+	defer channel.Unlock()
+	if channel.moderatorActionWaiters[key] == waiter {
+		delete(channel.moderatorActionWaiters, key)
+	}
+
+	action, ok = channel.moderatorActions[key]
+	if ok && time.Since(action.receivedAt) <= moderatorActionTTL {
+		return &action.event
+	}
+
+	return nil
+}
+
+// setModeratorActionsListening is called when PubSub starts or stops listening to the moderator actions,
+// clearchat and clearmsg stop waiting for moderator actions which will not arrive
+func (channel *TwitchChannel) setModeratorActionsListening(listening bool) {
+	channel.Lock()
+	defer channel.Unlock()
+
+	channel.moderatorActionsListening = listening
+	if listening {
+		return
+	}
+
+	for key, waiter := range channel.moderatorActionWaiters {
+		close(waiter)
+		delete(channel.moderatorActionWaiters, key)
+	}
+}
+
+// chatLogMessages returns the messages of the chat log in the data service, the newest first
+func (twitch *Twitch) chatLogMessages(query url.Values) ([]TwitchChatLogMessage, error) {
+	var messages []TwitchChatLogMessage
+	err := steveRequest(http.MethodGet, "/chat/messages?"+query.Encode(), nil, &messages)
+	if err != nil {
+		log.Error("Chat log: ", err)
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// enrichClearchat adds the moderator action and the removed messages of the user to the clearchat,
+// the messages are from the current stream and at most clearchatMessagesMaxAge old
+func (twitch *Twitch) enrichClearchat(channelName string, username string) TwitchClearchat {
+	clearchat := TwitchClearchat{
+		Username: username,
+	}
+
+	if channel := twitch.channel(channelName); channel != nil {
+		if action := channel.moderatorAction("user:" + strings.ToLower(username)); action != nil {
+			clearchat.Duration = action.Duration
+			clearchat.Permanent = action.Action == "ban"
+			clearchat.Reason = action.Reason
+			clearchat.Moderator = action.Moderator
+		}
+
+		if username != "" {
+			from := time.Now().Add(-clearchatMessagesMaxAge)
+			channel.RLock()
+			if channel.stream != nil && channel.stream.StartedAt.After(from) {
+				from = channel.stream.StartedAt
+			}
+			channel.RUnlock()
+
+			clearchat.Messages, _ = twitch.chatLogMessages(url.Values{
+				"channel":  {channel.name},
+				"username": {username},
+				"from":     {from.UTC().Format(time.RFC3339)},
+				"limit":    {strconv.Itoa(clearchatMessages)},
+			})
+		}
+	}
+
+	return clearchat
+}
+
+// enrichClearmsg adds the moderator and the content of the deleted message to the clearmsg
+func (twitch *Twitch) enrichClearmsg(channelName string, username string, msgID string) TwitchClearmsg {
+	clearmsg := TwitchClearmsg{
+		Username: username,
+		MsgID:    msgID,
+	}
+
+	if channel := twitch.channel(channelName); channel != nil {
+		if action := channel.moderatorAction("msg:" + msgID); action != nil {
+			clearmsg.Content = action.Content
+			clearmsg.Moderator = action.Moderator
+		}
+
+		if clearmsg.Content == "" {
+			if messages, err := twitch.chatLogMessages(url.Values{"id": {msgID}}); err == nil && len(messages) > 0 {
+				clearmsg.Content = messages[0].Content
+			}
+		}
+	}
+
+	return clearmsg
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+)
+
+// registerUser creates the unknown chatter in the data service with the welcome taler
+// and lets the overlays welcome them
+func (twitch *Twitch) registerUser(channel *TwitchChannel, m *TwitchMessage) {
+	body := map[string]interface{}{
+		"username": m.User.Username,
+		"taler":    envInt("WELCOME_TALER", 0),
+	}
+	if m.User.ID != "" {
+		body["twitchID"] = m.User.ID
+	}
+
+	err := steveRequest(http.MethodPost, "/user", body, &m.User)
+	if err != nil {
+		// 409 if another message of the user was faster
+		log.Error("Register user: ", err)
+		return
+	}
+
+	log.Info("New user in ", channel.name, ": ", m.User.Username)
+
+	hugo.hub.broadcast(channel.name, TwitchNewUser{
+		ID:          m.User.ID,
+		Username:    m.User.Username,
+		DisplayName: m.User.DisplayName,
+		Color:       m.User.Color,
+		LogoURL:     m.User.LogoURL,
+		Taler:       m.User.Taler,
+	})
+}
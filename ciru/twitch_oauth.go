@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// newOAuthState creates a random state for the authorization request
+// which has to be sent back by Twitch within oauthStateTTL
+func (twitch *Twitch) newOAuthState(channel *TwitchChannel) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	state := hex.EncodeToString(b)
+
+	twitch.Lock()
+	defer twitch.Unlock()
+	for s, oauthState := range twitch.oauthStates {
+		if time.Now().After(oauthState.expiresAt) {
+			delete(twitch.oauthStates, s)
+		}
+	}
+	twitch.oauthStates[state] = &TwitchOAuthState{
+		channel:   channel,
+		expiresAt: time.Now().Add(oauthStateTTL),
+	}
+
+	return state, nil
+}
+
+// verifyOAuthState checks if the state was issued by us and removes it
+// so that it can not be used twice. It returns the channel the login was started for.
+func (twitch *Twitch) verifyOAuthState(state string) (*TwitchChannel, bool) {
+	twitch.Lock()
+	defer twitch.Unlock()
+
+	oauthState, ok := twitch.oauthStates[state]
+	if !ok {
+		return nil, false
+	}
+	delete(twitch.oauthStates, state)
+
+	return oauthState.channel, time.Now().Before(oauthState.expiresAt)
+}
+
+// tokenCipher returns the cipher used to encrypt the persisted oauth token
+// or nil if token persistence is not configured
+func tokenCipher() (cipher.AEAD, error) {
+	if os.Getenv("TWITCH_TOKEN_FILE") == "" || os.Getenv("TWITCH_TOKEN_KEY") == "" {
+		return nil, nil
+	}
+
+	key := sha256.Sum256([]byte(os.Getenv("TWITCH_TOKEN_KEY")))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// tokenFile returns the path of the persisted token of the channel,
+// the channel name is added in front of the extension of TWITCH_TOKEN_FILE
+func (channel *TwitchChannel) tokenFile() string {
+	tokenFile := os.Getenv("TWITCH_TOKEN_FILE")
+	ext := filepath.Ext(tokenFile)
+	return strings.TrimSuffix(tokenFile, ext) + "." + channel.name + ext
+}
+
+func (channel *TwitchChannel) saveOAuthToken(token *oauth2.Token) error {
+	gcm, err := tokenCipher()
+	if err != nil || gcm == nil {
+		return err
+	}
+
+	plaintext, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	// the nonce is stored in front of the encrypted token
+	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
+
+	return ioutil.WriteFile(channel.tokenFile(), ciphertext, 0600)
+}
+
+func (channel *TwitchChannel) loadOAuthToken() (*oauth2.Token, error) {
+	gcm, err := tokenCipher()
+	if err != nil || gcm == nil {
+		return nil, err
+	}
+
+	ciphertext, err := ioutil.ReadFile(channel.tokenFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("token file is too short")
+	}
+
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var token oauth2.Token
+	err = json.Unmarshal(plaintext, &token)
+	if err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+func (twitch *Twitch) validateOAuthToken(accessToken string) (*TwitchTokenValidation, error) {
+	req, err := http.NewRequest(http.MethodGet, "https://id.twitch.tv/oauth2/validate", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", "OAuth "+accessToken)
+
+	res, err := twitch.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusUnauthorized {
+		return nil, errTokenInvalid
+	} else if res.StatusCode != http.StatusOK {
+		return nil, errors.New("token validation returned " + res.Status)
+	}
+
+	var validation TwitchTokenValidation
+	err = json.NewDecoder(res.Body).Decode(&validation)
+	if err != nil {
+		return nil, err
+	}
+	validation.ExpiresAt = time.Now().Add(time.Duration(validation.ExpiresIn) * time.Second)
+
+	return &validation, nil
+}
+
+func newTwitchTokenSource(ctx context.Context, config *oauth2.Config, onChange func(*oauth2.Token)) *TwitchTokenSource {
+	return &TwitchTokenSource{
+		Mutex:    &sync.Mutex{},
+		ctx:      ctx,
+		config:   config,
+		onChange: onChange,
+	}
+}
+
+// set replaces the current token, e.g. after a new login
+func (tokenSource *TwitchTokenSource) set(token *oauth2.Token) {
+	tokenSource.Lock()
+	tokenSource.token = token
+	tokenSource.source = tokenSource.config.TokenSource(tokenSource.ctx, token)
+	tokenSource.Unlock()
+
+	tokenSource.onChange(token)
+}
+
+// clear drops the current token, a new login is required afterwards
+func (tokenSource *TwitchTokenSource) clear() {
+	tokenSource.Lock()
+	defer tokenSource.Unlock()
+	tokenSource.token = nil
+	tokenSource.source = nil
+}
+
+// expire marks the current token as expired so the next call to Token refreshes it
+func (tokenSource *TwitchTokenSource) expire() {
+	tokenSource.Lock()
+	defer tokenSource.Unlock()
+	if tokenSource.token == nil {
+		return
+	}
+
+	token := *tokenSource.token
+	token.Expiry = time.Now().Add(-time.Minute)
+	tokenSource.token = &token
+	tokenSource.source = tokenSource.config.TokenSource(tokenSource.ctx, &token)
+}
+
+// Token returns a valid token and refreshes it shortly before it expires.
+// Transient errors are retried, the current token is never dropped on failure.
+// The lock is only held to read and update the token, so callers are not blocked by the retries.
+func (tokenSource *TwitchTokenSource) Token() (*oauth2.Token, error) {
+	tokenSource.Lock()
+	source := tokenSource.source
+	current := tokenSource.token
+	tokenSource.Unlock()
+
+	if source == nil {
+		return nil, errNoToken
+	}
+
+	var err error
+	for attempt := 1; attempt <= tokenRefreshAttempts; attempt++ {
+		var token *oauth2.Token
+		token, err = source.Token()
+		if err == nil {
+			tokenSource.Lock()
+			// the token could have been replaced by a login in the meantime
+			changed := tokenSource.source == source && token.AccessToken != tokenSource.token.AccessToken
+			if changed {
+				tokenSource.token = token
+			}
+			tokenSource.Unlock()
+
+			if changed {
+				log.Info("Refreshed access token, valid until ", token.Expiry)
+				tokenSource.onChange(token)
+			}
+			return token, nil
+		}
+
+		if !isTransientTokenError(err) {
+			break
+		}
+
+		// the refresh starts shortly before the expiry, until then the current token can still be used
+		if current != nil && time.Now().Before(current.Expiry) {
+			log.Error("Could not refresh access token, using the current one: ", err)
+			return current, nil
+		}
+
+		log.Error("Could not refresh access token (attempt ", attempt, "): ", err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+
+	log.Error("Could not refresh access token: ", err)
+	return nil, err
+}
+
+func isTransientTokenError(err error) bool {
+	var retrieveError *oauth2.RetrieveError
+	if errors.As(err, &retrieveError) {
+		return retrieveError.Response.StatusCode >= http.StatusInternalServerError || retrieveError.Response.StatusCode == http.StatusTooManyRequests
+	}
+
+	// network errors and timeouts
+	return true
+}
+
+func (twitch *Twitch) validateAccessTokens() {
+	for _, channel := range twitch.channels {
+		twitch.validateAccessToken(channel)
+	}
+}
+
+func (twitch *Twitch) validateAccessToken(channel *TwitchChannel) {
+	token, err := channel.tokenSource.Token()
+	if err == errNoToken {
+		return
+	} else if err != nil {
+		log.Error("Validate access token of ", channel.name, ": ", err)
+		return
+	}
+
+	_, err = twitch.validateOAuthToken(token.AccessToken)
+	if err == errTokenInvalid {
+		// the token could have been invalidated before its expiry time,
+		// a refresh tells us if we still have access
+		log.Info("Access token of ", channel.name, " is invalid, trying to refresh it")
+		channel.tokenSource.expire()
+		if _, err := channel.tokenSource.Token(); err != nil && !isTransientTokenError(err) {
+			log.Error("Access token of ", channel.name, " was revoked, login required: ", err)
+			channel.tokenSource.clear()
+		}
+	} else if err != nil {
+		log.Error("Validate access token of ", channel.name, ": ", err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// eventPoll handles channel.poll.begin, channel.poll.progress and channel.poll.end
+func (twitch *Twitch) eventPoll(stage string) func(channel *TwitchChannel, event json.RawMessage) {
+	return func(channel *TwitchChannel, event json.RawMessage) {
+		var e struct {
+			ID      string `json:"id"`
+			Title   string `json:"title"`
+			Status  string `json:"status"`
+			Choices []struct {
+				ID                 string `json:"id"`
+				Title              string `json:"title"`
+				Votes              int    `json:"votes"`
+				BitsVotes          int    `json:"bits_votes"`
+				ChannelPointsVotes int    `json:"channel_points_votes"`
+			} `json:"choices"`
+			StartedAt time.Time `json:"started_at"`
+			EndsAt    time.Time `json:"ends_at"`
+			EndedAt   time.Time `json:"ended_at"`
+		}
+		err := json.Unmarshal(event, &e)
+		if err != nil {
+			log.Error("Poll: could not unmarshal event: ", err)
+			return
+		}
+
+		poll := TwitchPoll{
+			event:     "poll:" + stage,
+			ID:        e.ID,
+			Title:     e.Title,
+			Status:    strings.ToLower(e.Status),
+			StartedAt: e.StartedAt,
+			EndsAt:    e.EndsAt,
+			EndedAt:   e.EndedAt,
+		}
+		if poll.Status == "" {
+			poll.Status = "active"
+		}
+
+		for _, c := range e.Choices {
+			poll.TotalVotes += c.Votes
+		}
+		for _, c := range e.Choices {
+			poll.Choices = append(poll.Choices, TwitchPollChoice{
+				ID:         c.ID,
+				Title:      c.Title,
+				Votes:      c.Votes,
+				Percentage: percentage(c.Votes, poll.TotalVotes),
+			})
+		}
+
+		hugo.hub.broadcast(channel.name, poll)
+
+		if stage == "end" {
+			err := steveRequest(http.MethodPost, "/poll", map[string]interface{}{
+				"id":        poll.ID,
+				"channel":   channel.name,
+				"title":     poll.Title,
+				"status":    poll.Status,
+				"choices":   poll.Choices,
+				"startedAt": poll.StartedAt,
+				"endedAt":   poll.EndedAt,
+			}, nil)
+			if err != nil {
+				log.Error("Poll: could not record poll: ", err)
+			}
+		}
+	}
+}
+
+// eventPrediction handles channel.prediction.begin, channel.prediction.progress,
+// channel.prediction.lock and channel.prediction.end
+func (twitch *Twitch) eventPrediction(stage string) func(channel *TwitchChannel, event json.RawMessage) {
+	return func(channel *TwitchChannel, event json.RawMessage) {
+		var e struct {
+			ID               string `json:"id"`
+			Title            string `json:"title"`
+			Status           string `json:"status"`
+			WinningOutcomeID string `json:"winning_outcome_id"`
+			Outcomes         []struct {
+				ID            string `json:"id"`
+				Title         string `json:"title"`
+				Color         string `json:"color"`
+				Users         int    `json:"users"`
+				ChannelPoints int    `json:"channel_points"`
+				TopPredictors []struct {
+					UserID            string `json:"user_id"`
+					UserLogin         string `json:"user_login"`
+					UserName          string `json:"user_name"`
+					ChannelPointsUsed int    `json:"channel_points_used"`
+					ChannelPointsWon  int    `json:"channel_points_won"`
+				} `json:"top_predictors"`
+			} `json:"outcomes"`
+			StartedAt time.Time `json:"started_at"`
+			LocksAt   time.Time `json:"locks_at"`
+			LockedAt  time.Time `json:"locked_at"`
+			EndedAt   time.Time `json:"ended_at"`
+		}
+		err := json.Unmarshal(event, &e)
+		if err != nil {
+			log.Error("Prediction: could not unmarshal event: ", err)
+			return
+		}
+
+		prediction := TwitchPrediction{
+			event:            "prediction:" + stage,
+			ID:               e.ID,
+			Title:            e.Title,
+			Status:           strings.ToLower(e.Status),
+			WinningOutcomeID: e.WinningOutcomeID,
+			StartedAt:        e.StartedAt,
+			LocksAt:          e.LocksAt,
+			LockedAt:         e.LockedAt,
+			EndedAt:          e.EndedAt,
+		}
+		if prediction.Status == "" {
+			prediction.Status = "active"
+			if stage == "lock" {
+				prediction.Status = "locked"
+			}
+		}
+
+		for _, o := range e.Outcomes {
+			prediction.TotalChannelPoints += o.ChannelPoints
+			prediction.TotalUsers += o.Users
+		}
+		for _, o := range e.Outcomes {
+			outcome := TwitchPredictionOutcome{
+				ID:            o.ID,
+				Title:         o.Title,
+				Color:         strings.ToLower(o.Color),
+				Users:         o.Users,
+				ChannelPoints: o.ChannelPoints,
+				Percentage:    percentage(o.ChannelPoints, prediction.TotalChannelPoints),
+			}
+			for _, p := range o.TopPredictors {
+				outcome.TopPredictors = append(outcome.TopPredictors, TwitchPredictor{
+					UserID:            p.UserID,
+					Username:          p.UserLogin,
+					DisplayName:       p.UserName,
+					ChannelPointsUsed: p.ChannelPointsUsed,
+					ChannelPointsWon:  p.ChannelPointsWon,
+				})
+			}
+			prediction.Outcomes = append(prediction.Outcomes, outcome)
+		}
+
+		hugo.hub.broadcast(channel.name, prediction)
+
+		if stage == "end" {
+			err := steveRequest(http.MethodPost, "/prediction", map[string]interface{}{
+				"id":                 prediction.ID,
+				"channel":            channel.name,
+				"title":              prediction.Title,
+				"status":             prediction.Status,
+				"winningOutcomeID":   prediction.WinningOutcomeID,
+				"totalChannelPoints": prediction.TotalChannelPoints,
+				"outcomes":           prediction.Outcomes,
+				"startedAt":          prediction.StartedAt,
+				"endedAt":            prediction.EndedAt,
+			}, nil)
+			if err != nil {
+				log.Error("Prediction: could not record prediction: ", err)
+			}
+		}
+	}
+}
+
+// percentage returns part of total in percent rounded to one decimal
+func percentage(part int, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+
+	return math.Round(float64(part)*1000/float64(total)) / 10
+}
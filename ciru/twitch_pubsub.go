@@ -2,18 +2,20 @@ package main
 
 import (
 	"encoding/json"
-	"io/ioutil"
 	"net/http"
-	"os"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-func newTwitchPubSub() *TwitchPubSub {
+// the moderator topic is listened to on its own because it needs the channel:moderate scope,
+// its failure is identified by this nonce and does not affect the other topics
+const pubSubModeratorActionsNonce = "chat_moderator_actions"
+
+func newTwitchPubSub(channel *TwitchChannel) *TwitchPubSub {
 	pb := &TwitchPubSub{
+		channel:       channel,
 		closeConn:     make(chan bool),
 		writeMessages: make(chan *TwitchPubSubRequest),
 	}
@@ -23,7 +25,7 @@ func newTwitchPubSub() *TwitchPubSub {
 }
 
 func (twitchPubSub *TwitchPubSub) init() {
-	log.Info("Init PubSub")
+	log.Info("Init PubSub for ", twitchPubSub.channel.name)
 
 	// reset to default
 	// method could be called again due to reconnect
@@ -31,11 +33,7 @@ func (twitchPubSub *TwitchPubSub) init() {
 	twitchPubSub.writeListenerClosed = false
 
 	// we dont receive any information from pubsub if we can not authenticate
-	twitch.RLock()
-	accessToken := twitch.oauthToken.AccessToken
-	twitch.RUnlock()
-
-	if accessToken == "" {
+	if _, err := twitchPubSub.channel.tokenSource.Token(); err != nil {
 		var stopWaiting bool
 
 		// we are already in a goroutine, so we are not blocking anything
@@ -43,14 +41,12 @@ func (twitchPubSub *TwitchPubSub) init() {
 		for !stopWaiting {
 			select {
 			case <-t.C:
-				twitch.RLock()
-				if twitch.oauthToken != nil && twitch.oauthToken.AccessToken != "" {
+				if _, err := twitchPubSub.channel.tokenSource.Token(); err == nil {
 					log.Info("PubSub: access token available, connecting to PubSub")
 					stopWaiting = true
 				} else {
-					log.Info("PubSub: no access token available to authenticate, waiting for login")
+					log.Info("PubSub: no access token available to authenticate, waiting for login: ", err)
 				}
-				twitch.RUnlock()
 			}
 		}
 	}
@@ -64,8 +60,8 @@ func (twitchPubSub *TwitchPubSub) init() {
 
 	// send ping messages to pubsub websocket every 4 1/2 minutes
 	// should happen at least every 5 seconds
-	cron.Stop("pubsub:_ping")
-	cron.New("pubsub:_ping", twitchPubSub.ping, 270*time.Second)
+	cron.Stop("pubsub:" + twitchPubSub.channel.name + ":_ping")
+	cron.New("pubsub:"+twitchPubSub.channel.name+":_ping", twitchPubSub.ping, 270*time.Second)
 
 	go twitchPubSub.readListener()
 	go twitchPubSub.writeListener()
@@ -89,11 +85,27 @@ func (twitchPubSub *TwitchPubSub) init() {
 func (twitchPubSub *TwitchPubSub) sendListenMessages() {
 	log.Info("PubSub: send listen event")
 
+	token, err := twitchPubSub.channel.tokenSource.Token()
+	if err != nil {
+		log.Error("PubSub: could not get access token: ", err)
+		twitchPubSub.close()
+		return
+	}
+
 	twitchPubSub.write(&TwitchPubSubRequest{
 		Type: "LISTEN",
 		Data: &TwitchPubSubRequestData{
-			Topics:    []string{"channel-points-channel-v1." + twitch.channelID, "channel-subscribe-events-v1." + twitch.channelID, "channel-bits-events-v2." + twitch.channelID},
-			AuthToken: twitch.oauthToken.AccessToken,
+			Topics:    []string{"channel-points-channel-v1." + twitchPubSub.channel.id, "channel-subscribe-events-v1." + twitchPubSub.channel.id, "channel-bits-events-v2." + twitchPubSub.channel.id},
+			AuthToken: token.AccessToken,
+		},
+	})
+
+	twitchPubSub.write(&TwitchPubSubRequest{
+		Type:  "LISTEN",
+		Nonce: pubSubModeratorActionsNonce,
+		Data: &TwitchPubSubRequestData{
+			Topics:    []string{"chat_moderator_actions." + twitchPubSub.channel.id + "." + twitchPubSub.channel.id},
+			AuthToken: token.AccessToken,
 		},
 	})
 }
@@ -109,6 +121,7 @@ func (twitchPubSub *TwitchPubSub) ping() {
 func (twitchPubSub *TwitchPubSub) readListener() {
 	defer func(twitchPubSub *TwitchPubSub) {
 		twitchPubSub.conn.Close()
+		twitchPubSub.channel.setModeratorActionsListening(false)
 		twitchPubSub.readListenerClosed = true
 	}(twitchPubSub)
 
@@ -128,8 +141,11 @@ func (twitchPubSub *TwitchPubSub) readListener() {
 			continue
 		}
 
-		if r.Error != "" {
-			log.Error("PubSub: Twitch error: ", err)
+		if r.Error != "" && r.Nonce == pubSubModeratorActionsNonce {
+			log.Warn("PubSub: could not listen to moderator actions, clearchat and clearmsg are sent without them: ", r.Error)
+			continue
+		} else if r.Error != "" {
+			log.Error("PubSub: Twitch error: ", r.Error)
 			continue
 		}
 
@@ -139,6 +155,12 @@ func (twitchPubSub *TwitchPubSub) readListener() {
 			twitchPubSub.close()
 			return
 
+		case "RESPONSE":
+			if r.Nonce == pubSubModeratorActionsNonce {
+				log.Info("PubSub: listening to moderator actions")
+				twitchPubSub.channel.setModeratorActionsListening(true)
+			}
+
 		case "PONG":
 			log.Info("PubSub: received PONG")
 			if twitchPubSub.lastPing.Add(10 * time.Second).Before(time.Now()) {
@@ -159,10 +181,10 @@ func (twitchPubSub *TwitchPubSub) readListener() {
 				}
 
 				if strings.Contains(strings.ToLower(m.Data.Redemption.Reward.Title), "reputation") {
-					twitchPubSub.addReputationPointsToUser(m.Data.Redemption.User.Login, m.Data.Redemption.Reward.Cost)
+					addReputationPointsToUser(m.Data.Redemption.User.Login, m.Data.Redemption.User.ID, m.Data.Redemption.Reward.Cost)
 				}
 
-				hugo.hub.broadcast(m)
+				hugo.hub.broadcast(twitchPubSub.channel.name, m)
 			} else if strings.HasPrefix(r.Data.Topic, "channel-bits-events-v2") {
 				var m TwitchPubSubMessageCheer
 				err := json.Unmarshal([]byte(r.Data.Message), &m)
@@ -171,7 +193,20 @@ func (twitchPubSub *TwitchPubSub) readListener() {
 					continue
 				}
 
-				twitchPubSub.addReputationPointsToUser(m.Data.Username, m.Data.BitsUsed*10)
+				addReputationPointsToUser(m.Data.Username, m.Data.UserID, m.Data.BitsUsed*10)
+				recordUserActivity(m.Data.Username, m.Data.UserID, TwitchUserActivity{
+					SeenAt: m.Data.Time,
+					Bits:   m.Data.BitsUsed,
+				})
+			} else if strings.HasPrefix(r.Data.Topic, "chat_moderator_actions") {
+				var m TwitchPubSubMessageModeratorAction
+				err := json.Unmarshal([]byte(r.Data.Message), &m)
+				if err != nil {
+					log.Error("PubSub: could not unmarshal message: ", err)
+					continue
+				}
+
+				twitch.eventModeratorAction(twitchPubSub.channel, m)
 			} else if strings.HasPrefix(r.Data.Topic, "channel-subscribe-events-v1") {
 				log.Info("PubSub: new sub event")
 				var m TwitchPubSubMessageSub
@@ -183,16 +218,31 @@ func (twitchPubSub *TwitchPubSub) readListener() {
 
 				if strings.HasPrefix(m.Context, "anon") {
 					log.Debug("PubSub: sending 2500 reputation points to ", m.RecipientUserName)
-					twitchPubSub.addReputationPointsToUser(m.RecipientUserName, 2500)
+					addReputationPointsToUser(m.RecipientUserName, m.RecipientID, 2500)
 				} else if strings.HasSuffix(m.Context, "gift") {
 					log.Debug("PubSub: sending 5000 reputation points to ", m.Username)
-					twitchPubSub.addReputationPointsToUser(m.Username, 5000)
+					addReputationPointsToUser(m.Username, m.UserID, 5000)
 					log.Debug("PubSub: sending 2500 reputation points to ", m.RecipientUserName)
-					twitchPubSub.addReputationPointsToUser(m.RecipientUserName, 2500)
+					addReputationPointsToUser(m.RecipientUserName, m.RecipientID, 2500)
+					recordUserActivity(m.Username, m.UserID, TwitchUserActivity{
+						SeenAt:     m.Time,
+						SubsGifted: 1,
+					})
 				} else if strings.HasSuffix(m.Context, "sub") {
 					log.Debug("PubSub: sending 2500 reputation points to ", m.RecipientUserName)
-					twitchPubSub.addReputationPointsToUser(m.Username, 2500)
+					addReputationPointsToUser(m.Username, m.UserID, 2500)
+					recordUserActivity(m.Username, m.UserID, TwitchUserActivity{
+						SeenAt:           m.Time,
+						MonthsSubscribed: m.CumulativeMonths,
+					})
 				}
+
+				// Twitch needs a moment until new subscriptions show up in the api
+				time.AfterFunc(subscriptionsRefreshDelay, func() {
+					if _, err := twitch.refreshSubscriptions(twitchPubSub.channel); err != nil {
+						log.Error("PubSub: could not refresh subscriptions: ", err)
+					}
+				})
 			}
 		}
 	}
@@ -233,32 +283,3 @@ func (twitchPubSub *TwitchPubSub) write(r *TwitchPubSubRequest) {
 func (twitchPubSub *TwitchPubSub) close() {
 	twitchPubSub.closeConn <- true
 }
-
-func (twitchPubSub *TwitchPubSub) addReputationPointsToUser(username string, reputationPoints int) {
-	requestURL := strings.Trim(os.Getenv("STEVE_URL"), " /") + "/user/" + username + "/reputation_points?reputation_points=" + strconv.Itoa(reputationPoints)
-	req, err := http.NewRequest(http.MethodPut, requestURL, nil)
-	log.Debug("Reputation points request url: ", requestURL)
-	if err != nil {
-		log.Error("Reputation points request prep: ", err)
-		return
-	}
-
-	client := http.Client{}
-	res, err := client.Do(req)
-	if err != nil {
-		log.Error("Reputation points request: ", err)
-		return
-	}
-
-	if res.StatusCode != 200 {
-		log.Error("Reputation points response: got ", res.StatusCode, " as response")
-		body, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			log.Error("Reputation points response read: ", err)
-			return
-		}
-		log.Debugf("Reputation points response: %s", body)
-
-		return
-	}
-}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// trackChatVelocity records the message and enables the raid protection of the channel if
+// the messages per second and the ratio of first-time chatters exceed the thresholds
+func (twitch *Twitch) trackChatVelocity(channel *TwitchChannel, username string) {
+	threshold := envFloat("RAID_PROTECTION_MESSAGES_PER_SECOND", 0)
+	if threshold <= 0 {
+		return
+	}
+
+	window := envDuration("RAID_PROTECTION_WINDOW", 10*time.Second)
+	minMessages := envInt("RAID_PROTECTION_MIN_MESSAGES", 20)
+	firstChatterRatio := float64(envInt("RAID_PROTECTION_FIRST_CHATTER_PERCENT", 50)) / 100
+
+	channel.Lock()
+	now := time.Now()
+	_, known := channel.knownChatters[username]
+	firstTime := !known
+	channel.knownChatters[username] = now
+	warmingUp := now.Sub(channel.knownChattersSince) < window
+
+	chatSamples := channel.chatSamples[:0]
+	for _, sample := range channel.chatSamples {
+		if now.Sub(sample.receivedAt) < window {
+			chatSamples = append(chatSamples, sample)
+		}
+	}
+	channel.chatSamples = append(chatSamples, TwitchChatSample{
+		receivedAt: now,
+		firstTime:  firstTime,
+	})
+
+	var firstTimeMessages int
+	for _, sample := range channel.chatSamples {
+		if sample.firstTime {
+			firstTimeMessages++
+		}
+	}
+	messages := len(channel.chatSamples)
+	channel.Unlock()
+
+	if warmingUp || messages < minMessages {
+		return
+	}
+
+	messagesPerSecond := float64(messages) / window.Seconds()
+	ratio := float64(firstTimeMessages) / float64(messages)
+	if messagesPerSecond >= threshold && ratio >= firstChatterRatio {
+		twitch.enableRaidProtection(channel, messagesPerSecond, ratio)
+	}
+}
+
+// loadKnownChatters seeds the known chatters of the channel with the authors of the
+// recent messages in the chat log, so that regulars are not first-time chatters after a restart
+func (twitch *Twitch) loadKnownChatters(channel *TwitchChannel) {
+	messages, err := twitch.chatLogMessages(url.Values{
+		"channel": {channel.name},
+		"limit":   {"1000"},
+	})
+	if err != nil {
+		return
+	}
+
+	channel.Lock()
+	for _, m := range messages {
+		username := strings.ToLower(m.Username)
+		if seenAt, ok := channel.knownChatters[username]; !ok || seenAt.Before(m.SentAt) {
+			channel.knownChatters[username] = m.SentAt
+		}
+	}
+	channel.Unlock()
+
+	log.Info("Raid protection: loaded ", len(messages), " messages of known chatters for ", channel.name)
+}
+
+// cleanKnownChatters forgets chatters who did not write within RAID_PROTECTION_KNOWN_CHATTER_TTL
+func (twitch *Twitch) cleanKnownChatters() {
+	ttl := envDuration("RAID_PROTECTION_KNOWN_CHATTER_TTL", 7*24*time.Hour)
+
+	for _, channel := range twitch.channels {
+		channel.Lock()
+		for username, seenAt := range channel.knownChatters {
+			if time.Since(seenAt) > ttl {
+				delete(channel.knownChatters, username)
+			}
+		}
+		channel.Unlock()
+	}
+}
+
+// raidProtectionOffCommands disable the chat modes which the raid protection enabled
+var raidProtectionOffCommands = map[string]string{
+	"followers": "/followersoff",
+	"slow":      "/slowoff",
+	"emoteonly": "/emoteonlyoff",
+	"subonly":   "/subscribersoff",
+}
+
+// raidProtectionModes returns the chat commands to enable the configured chat modes
+func raidProtectionModes() map[string]string {
+	modes := map[string]string{
+		"followers": "/followers " + strconv.Itoa(int(envDuration("RAID_PROTECTION_FOLLOWERS_DURATION", 10*time.Minute).Minutes())) + "m",
+		"slow":      "/slow " + strconv.Itoa(envInt("RAID_PROTECTION_SLOW_SECONDS", 10)),
+		"emoteonly": "/emoteonly",
+		"subonly":   "/subscribers",
+	}
+
+	configured := "followers,slow,emoteonly"
+	if s := strings.TrimSpace(strings.ToLower(os.Getenv("RAID_PROTECTION_MODES"))); s != "" {
+		configured = s
+	}
+
+	enabled := make(map[string]string)
+	for _, mode := range strings.Split(configured, ",") {
+		if command, ok := modes[strings.TrimSpace(mode)]; ok {
+			enabled[strings.TrimSpace(mode)] = command
+		}
+	}
+
+	return enabled
+}
+
+// activeChatModes returns the chat modes of the channel which are turned on, the keys match RAID_PROTECTION_MODES
+func (twitch *Twitch) activeChatModes(channel *TwitchChannel) (map[string]bool, error) {
+	body, err := twitch.apiRequest(channel.oAuthHTTPClient, http.MethodGet, "https://api.twitch.tv/helix/chat/settings?broadcaster_id="+channel.id, nil, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var res struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	err = json.Unmarshal(body, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	active := make(map[string]bool)
+	if len(res.Data) == 0 {
+		return active, nil
+	}
+	for mode, setting := range moderationChatModes {
+		if on, ok := res.Data[0][setting].(bool); ok && on {
+			active[mode] = true
+		}
+	}
+
+	return active, nil
+}
+
+func (twitch *Twitch) enableRaidProtection(channel *TwitchChannel, messagesPerSecond float64, firstChatterRatio float64) {
+	cooldown := envDuration("RAID_PROTECTION_COOLDOWN", 5*time.Minute)
+
+	channel.Lock()
+	if channel.raidProtection != nil {
+		// the raid is still going on, keep the protection active
+		channel.raidProtection.Until = time.Now().Add(cooldown)
+		channel.raidProtectionTimer.Reset(cooldown)
+		channel.Unlock()
+		return
+	}
+
+	raidProtection := &TwitchRaidProtection{
+		Active:            true,
+		MessagesPerSecond: messagesPerSecond,
+		FirstChatterRatio: firstChatterRatio,
+		Since:             time.Now(),
+		Until:             time.Now().Add(cooldown),
+	}
+	channel.raidProtection = raidProtection
+	channel.raidProtectionTimer = time.AfterFunc(cooldown, func() {
+		twitch.disableRaidProtection(channel)
+	})
+	channel.Unlock()
+
+	// modes which the mods turned on before the raid are left alone and stay on afterwards
+	active, err := twitch.activeChatModes(channel)
+	if err != nil {
+		log.Error("Raid protection: could not get the chat modes of ", channel.name, ": ", err)
+	}
+	commands := raidProtectionModes()
+	var modes []string
+	for mode := range commands {
+		if !active[mode] {
+			modes = append(modes, mode)
+		}
+	}
+
+	channel.Lock()
+	if channel.raidProtection != raidProtection {
+		// disabled in the meantime
+		channel.Unlock()
+		return
+	}
+	raidProtection.Modes = modes
+	// the struct is modified while the raid is going on, only copies are used outside of the lock
+	event := *raidProtection
+	channel.Unlock()
+
+	log.Info("Raid protection: enabled for ", channel.name, " with ", messagesPerSecond, " messages per second")
+
+	for _, mode := range modes {
+		twitch.say(channel, commands[mode], chatPriorityModeration)
+	}
+
+	twitch.say(channel, "/me Raid protection enabled ("+strings.Join(modes, ", ")+"), mods please keep an eye on the chat", chatPriorityModeration)
+	hugo.hub.broadcast(channel.name, event)
+}
+
+func (twitch *Twitch) disableRaidProtection(channel *TwitchChannel) {
+	channel.Lock()
+	raidProtection := channel.raidProtection
+	channel.raidProtection = nil
+	channel.chatSamples = nil
+	channel.Unlock()
+
+	if raidProtection == nil {
+		return
+	}
+
+	log.Info("Raid protection: disabled for ", channel.name)
+
+	// only the modes which the raid protection turned on
+	for _, mode := range raidProtection.Modes {
+		twitch.say(channel, raidProtectionOffCommands[mode], chatPriorityModeration)
+	}
+	twitch.say(channel, "/me Raid protection disabled", chatPriorityModeration)
+
+	raidProtection.Active = false
+	raidProtection.Until = time.Now()
+	hugo.hub.broadcast(channel.name, *raidProtection)
+}
+
+func (channel *TwitchChannel) raidProtectionActive() bool {
+	channel.RLock()
+	defer channel.RUnlock()
+	return channel.raidProtection != nil
+}
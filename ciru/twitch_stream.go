@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// onStreamEvent registers a hook which is called on every lifecycle
+// transition (streamOnline, streamOffline, streamUpdate) of any channel
+func (twitch *Twitch) onStreamEvent(hook func(channel *TwitchChannel, event string, stream TwitchStream)) {
+	twitch.Lock()
+	defer twitch.Unlock()
+	twitch.streamHooks = append(twitch.streamHooks, hook)
+}
+
+// updateStream compares the current stream of the channel with the previous one,
+// records the session in steve and notifies the hub and all hooks about transitions.
+// stream is nil if the channel is offline.
+func (twitch *Twitch) updateStream(channel *TwitchChannel, stream *TwitchStream) {
+	channel.RLock()
+	previous := channel.stream
+	channel.RUnlock()
+
+	var event string
+	switch {
+	case previous == nil && stream == nil:
+		return
+
+	case previous == nil:
+		event = streamOnline
+		stream.SessionID = startStreamSession(channel, stream)
+
+	case stream == nil:
+		event = streamOffline
+		stream = previous
+		if stream.SessionID > 0 {
+			err := steveRequest(http.MethodPut, "/stream_session/"+strconv.Itoa(stream.SessionID)+"/end", nil, nil)
+			if err != nil {
+				log.Error("Could not end stream session of ", channel.name, ": ", err)
+			}
+		}
+
+	default:
+		stream.SessionID = previous.SessionID
+		if stream.SessionID == 0 {
+			// the session could not be started when the stream went online
+			stream.SessionID = startStreamSession(channel, stream)
+		}
+		if stream.Title != previous.Title || stream.Game != previous.Game {
+			event = streamUpdate
+			if stream.SessionID > 0 {
+				err := steveRequest(http.MethodPut, "/stream_session/"+strconv.Itoa(stream.SessionID), map[string]string{
+					"title": stream.Title,
+					"game":  stream.Game,
+				}, nil)
+				if err != nil {
+					log.Error("Could not update stream session of ", channel.name, ": ", err)
+				}
+			}
+		}
+	}
+
+	if event != streamOffline && stream.SessionID > 0 {
+		err := steveRequest(http.MethodPost, "/stream_session/"+strconv.Itoa(stream.SessionID)+"/sample?viewers="+strconv.Itoa(stream.Viewers), nil, nil)
+		if err != nil {
+			log.Error("Could not sample viewers of ", channel.name, ": ", err)
+		}
+	}
+
+	channel.Lock()
+	if event == streamOffline {
+		channel.stream = nil
+	} else {
+		channel.stream = stream
+	}
+	channel.Unlock()
+
+	if event == "" {
+		return
+	}
+
+	log.Info("Stream event ", event, " for ", channel.name)
+	hugo.hub.broadcast(channel.name, TwitchStreamEvent{
+		event:        event,
+		TwitchStream: *stream,
+	})
+
+	twitch.RLock()
+	hooks := twitch.streamHooks
+	twitch.RUnlock()
+	for _, hook := range hooks {
+		hook(channel, event, *stream)
+	}
+}
+
+// startStreamSession records the start of the stream in steve and returns the id of the session,
+// 0 if steve is not reachable, it is retried with the next online check
+func startStreamSession(channel *TwitchChannel, stream *TwitchStream) int {
+	session := struct {
+		ID int `json:"id"`
+	}{}
+	err := steveRequest(http.MethodPost, "/stream_session", map[string]interface{}{
+		"channel":   channel.name,
+		"streamID":  stream.ID,
+		"title":     stream.Title,
+		"game":      stream.Game,
+		"startedAt": stream.StartedAt,
+	}, &session)
+	if err != nil {
+		log.Error("Could not start stream session of ", channel.name, ": ", err)
+	}
+
+	return session.ID
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
+	"regexp"
 	"sync"
 	"time"
 
@@ -15,40 +18,197 @@ type (
 		*sync.RWMutex
 
 		twirgo            *twirgo.Twitch
-		pubSub            *TwitchPubSub
 		automaticMessages *TwitchAutomaticMessages
+		eventSub          *TwitchEventSub
+		moderation        *TwitchModeration
+		enrichment        *TwitchEnrichment
+		chatQueue         *TwitchChatQueue
+		chatLog           *TwitchChatLog
 
-		channelID       string
-		clientID        string
-		httpClient      *http.Client
-		oAuthHTTPClient *http.Client
+		clientID   string
+		httpClient *http.Client
+
+		// key: channel name
+		channels map[string]*TwitchChannel
+		// in order of configuration, the first one is the default channel
+		channelNames []string
 
-		users map[string]*TwitchUserDetails
+		// key: username
+		users *Cache
+		// key: global or channel:{channel id}
+		badges *Cache
+		// key: channel id
+		cheermotes *Cache
 
-		bitsBadges       map[int64]*TwitchBadge
-		subscriberBadges map[int64]*TwitchBadge
-		globalBadges     map[string]map[string]*TwitchBadge
+		emoteProviders []TwitchEmoteProvider
+		// key: {provider}:global or {provider}:{channel id}
+		emotes *Cache
 
-		oauthToken  *oauth2.Token
 		oauthConfig *oauth2.Config
+		// key: state
+		oauthStates map[string]*TwitchOAuthState
+
+		streamHooks []func(channel *TwitchChannel, event string, stream TwitchStream)
+	}
+
+	TwitchChannel struct {
+		*sync.RWMutex
+
+		name   string
+		id     string
+		pubSub *TwitchPubSub
+
+		tokenSource     *TwitchTokenSource
+		oAuthHTTPClient *http.Client
+
+		subscriptions *TwitchSubscriptions
+
+		// nil if the channel is offline
+		stream *TwitchStream
+		// username of the first chatter of the current stream
+		firstChatter string
+
+		recentFollows    []time.Time
+		followBurst      *TwitchFollowBurst
+		followBurstTimer *time.Timer
+
+		// key: user id of the raider, value: time of the raid,
+		// raids are reported by IRC and EventSub
+		recentRaids map[string]time.Time
+
+		// nil if there is no hype train running
+		hypeTrain *TwitchHypeTrain
+
+		// key: username, value: time of the last message,
+		// seeded from the chat log and expired after RAID_PROTECTION_KNOWN_CHATTER_TTL
+		knownChatters map[string]time.Time
+		// the raid detection starts one window after this time
+		// because everyone is unknown right after a restart
+		knownChattersSince time.Time
+		chatSamples        []TwitchChatSample
+		// nil if the raid protection is not active
+		raidProtection      *TwitchRaidProtection
+		raidProtectionTimer *time.Timer
+
+		// recent actions of moderators from PubSub,
+		// key: user:{username} or msg:{message id}
+		moderatorActions map[string]TwitchModeratorAction
+		// true while PubSub listens to the moderator actions of the channel
+		moderatorActionsListening bool
+		// closed when the moderator action of the key arrives, key as in moderatorActions
+		moderatorActionWaiters map[string]chan bool
+	}
+
+	TwitchChatSample struct {
+		receivedAt time.Time
+		firstTime  bool
+	}
+
+	TwitchRaidProtection struct {
+		Active            bool      `json:"active"`
+		Modes             []string  `json:"modes"`
+		MessagesPerSecond float64   `json:"messagesPerSecond"`
+		FirstChatterRatio float64   `json:"firstChatterRatio"`
+		Since             time.Time `json:"since"`
+		Until             time.Time `json:"until"`
+	}
+
+	TwitchFollow struct {
+		UserID      string    `json:"userID"`
+		Username    string    `json:"username"`
+		DisplayName string    `json:"displayName"`
+		LogoURL     string    `json:"logoURL"`
+		FollowedAt  time.Time `json:"followedAt"`
+		// false if the user followed the channel before
+		FirstTime bool `json:"firstTime"`
+	}
+
+	TwitchFollowBurst struct {
+		Count     int       `json:"count"`
+		StartedAt time.Time `json:"startedAt"`
+		EndedAt   time.Time `json:"endedAt"`
+	}
+
+	TwitchRaid struct {
+		UserID      string `json:"userID"`
+		Username    string `json:"username"`
+		DisplayName string `json:"displayName"`
+		LogoURL     string `json:"logoURL"`
+		Viewers     int    `json:"viewers"`
+	}
+
+	TwitchStream struct {
+		ID        string    `json:"id"`
+		SessionID int       `json:"sessionID"`
+		Title     string    `json:"title"`
+		Game      string    `json:"game"`
+		Viewers   int       `json:"viewers"`
+		StartedAt time.Time `json:"startedAt"`
+	}
+
+	TwitchStreamEvent struct {
+		// streamOnline, streamOffline or streamUpdate
+		event string
+		TwitchStream
+	}
+
+	TwitchOAuthState struct {
+		channel   *TwitchChannel
+		expiresAt time.Time
+	}
+
+	TwitchTokenSource struct {
+		*sync.Mutex
+
+		ctx    context.Context
+		config *oauth2.Config
+		source oauth2.TokenSource
+		token  *oauth2.Token
 
-		isOnline bool
+		// called every time a new token was set or refreshed
+		onChange func(*oauth2.Token)
+	}
+
+	TwitchTokenValidation struct {
+		ClientID  string    `json:"client_id"`
+		Login     string    `json:"login"`
+		UserID    string    `json:"user_id"`
+		Scopes    []string  `json:"scopes"`
+		ExpiresIn int       `json:"expires_in"`
+		ExpiresAt time.Time `json:"-"`
+	}
+
+	TwitchSubscriptions struct {
+		Total  int `json:"total"`
+		Points int `json:"points"`
+		// key: tier (1000, 2000, 3000)
+		// value: amount of subscriptions
+		Tiers     map[string]int `json:"tiers"`
+		Gifted    int            `json:"gifted"`
+		Paid      int            `json:"paid"`
+		UpdatedAt time.Time      `json:"updatedAt"`
 	}
 
 	TwitchMessage struct {
-		ID          string         `json:"id"`
-		Timestamp   time.Time      `json:"timestamp"`
-		Content     string         `json:"content"`
-		IsCommand   bool           `json:"isCommand"`
-		Emotes      []*TwitchEmote `json:"emotes"`
-		ChannelName string         `json:"channelName"`
-		Highlighted bool           `json:"highlighted"`
-		Me          bool           `json:"me"`
-		User        struct {
-			ID                    string `json:"id"`
-			DisplayName           string `json:"displayName"`
-			Username              string `json:"username"`
-			Color                 string `json:"color"`
+		ID        string         `json:"id"`
+		Timestamp time.Time      `json:"timestamp"`
+		Content   string         `json:"content"`
+		IsCommand bool           `json:"isCommand"`
+		Emotes    []*TwitchEmote `json:"emotes"`
+		// the content split into text, emotes, cheermotes, mentions and urls
+		Fragments   []*TwitchMessageFragment `json:"fragments"`
+		ChannelName string                   `json:"channelName"`
+		Highlighted bool                     `json:"highlighted"`
+		Me          bool                     `json:"me"`
+		// bits cheered with the message, 0 for normal messages
+		Bits int `json:"bits"`
+		User struct {
+			ID          string `json:"id"`
+			DisplayName string `json:"displayName"`
+			Username    string `json:"username"`
+			Color       string `json:"color"`
+			// the color with enough contrast to the background of the overlay
+			AdjustedColor         string `json:"adjustedColor"`
 			IsPartner             bool   `json:"isPartner"`
 			IsFounder             bool   `json:"isFounder"`
 			IsMod                 bool   `json:"isMod"`
@@ -60,34 +220,278 @@ type (
 			SubscriberBadgeURL    string `json:"subscriberBadgeURL"`
 			// key: name
 			// value: amount
-			Badges           map[string]string `json:"badges"`
-			BadgeURLs        []string          `json:"badgeURLs"`
-			LogoURL          string            `json:"logoURL"`
-			Taler            int               `json:"taler"`
-			Status           string            `json:"status"`
-			Team             string            `json:"team"`
-			ReputationPoints int               `json:"reputationPoints"`
+			Badges    map[string]string `json:"badges"`
+			BadgeURLs []string          `json:"badgeURLs"`
+			// all badges of the user in display order
+			ResolvedBadges   []*TwitchResolvedBadge `json:"resolvedBadges"`
+			LogoURL          string                 `json:"logoURL"`
+			Taler            int                    `json:"taler"`
+			Status           string                 `json:"status"`
+			Team             string                 `json:"team"`
+			ReputationPoints int                    `json:"reputationPoints"`
+			FirstSeen        *time.Time             `json:"firstSeen"`
+			LastSeen         *time.Time             `json:"lastSeen"`
+			MessageCount     int                    `json:"messageCount"`
+			CommandCount     int                    `json:"commandCount"`
+			StreamsAttended  int                    `json:"streamsAttended"`
+			BitsTotal        int                    `json:"bitsTotal"`
+			SubsGifted       int                    `json:"subsGifted"`
+			MonthsSubscribed int                    `json:"monthsSubscribed"`
 		} `json:"user"`
 	}
 
+	TwitchNewUser struct {
+		ID          string `json:"id"`
+		Username    string `json:"username"`
+		DisplayName string `json:"displayName"`
+		Color       string `json:"color"`
+		LogoURL     string `json:"logoURL"`
+		Taler       int    `json:"taler"`
+	}
+
+	TwitchUserActivity struct {
+		SeenAt           time.Time `json:"seenAt"`
+		Messages         int       `json:"messages"`
+		Commands         int       `json:"commands"`
+		StreamSessionID  int       `json:"streamSessionID"`
+		Bits             int       `json:"bits"`
+		SubsGifted       int       `json:"subsGifted"`
+		MonthsSubscribed int       `json:"monthsSubscribed"`
+	}
+
+	TwitchEnrichment struct {
+		// all jobs in the order of the messages
+		ordered chan *TwitchEnrichmentJob
+		// jobs for the workers
+		pending  chan *TwitchEnrichmentJob
+		deadline time.Duration
+		users    *TwitchUserLookup
+
+		enrichMessage func(channel *TwitchChannel, m TwitchMessage) TwitchMessage
+	}
+
+	// TwitchEnrichmentJob is a chat message, clearchat or clearmsg
+	TwitchEnrichmentJob struct {
+		channelName string
+		// broadcasted if the enrichment misses the deadline
+		data     interface{}
+		enrich   func() interface{}
+		deadline time.Time
+		enriched chan interface{}
+	}
+
+	// TwitchChatLog sends the chat messages and tombstones one after another to the data service
+	TwitchChatLog struct {
+		requests chan TwitchChatLogRequest
+	}
+
+	TwitchChatLogRequest struct {
+		path string
+		body map[string]interface{}
+	}
+
+	TwitchChatQueue struct {
+		*sync.Mutex
+
+		send func(channel string, message string)
+		// signals the sender that messages were queued
+		wake chan bool
+
+		// messages per 30 seconds
+		limit    int
+		modLimit int
+		// maximum messages per priority lane and channel
+		laneSize int
+		// key: channel name, channels in which the bot is a moderator
+		modChannels map[string]bool
+
+		// key: channel name
+		channels map[string]*TwitchChatQueueChannel
+
+		// returns the current time, replaced in tests
+		now func() time.Time
+	}
+
+	TwitchChatQueueChannel struct {
+		// index: priority
+		lanes [chatPriorities][]string
+
+		// messages per chatRateWindow
+		limit int
+		// times of the sends within the last chatRateWindow, the oldest first
+		sentAt []time.Time
+
+		// key: message, value: time it was queued
+		recent map[string]time.Time
+	}
+
+	TwitchUserLookup struct {
+		*sync.Mutex
+
+		// key: username
+		cache *Cache
+
+		batchWindow time.Duration
+		batchSize   int
+
+		// key: username
+		batch      map[string]*TwitchUserLookupRequest
+		batchTimer *time.Timer
+	}
+
+	TwitchUserLookupRequest struct {
+		userID string
+		user   json.RawMessage
+		err    error
+		// closed when the request is done
+		done chan bool
+	}
+
 	TwitchClearchat struct {
+		// empty if the whole chat was cleared
 		Username string `json:"username"`
+		// seconds of the timeout, 0 for bans or if the moderator action is unknown
+		Duration  int    `json:"duration"`
+		Permanent bool   `json:"permanent"`
+		Reason    string `json:"reason"`
+		Moderator string `json:"moderator"`
+		// most recent messages of the user from the chat log
+		Messages []TwitchChatLogMessage `json:"messages"`
 	}
 
 	TwitchClearmsg struct {
 		Username string `json:"username"`
 		MsgID    string `json:"msgID"`
+		// content of the deleted message from the chat log
+		Content   string `json:"content"`
+		Moderator string `json:"moderator"`
+	}
+
+	TwitchChatLogMessage struct {
+		ID       string    `json:"id"`
+		Username string    `json:"username"`
+		Content  string    `json:"content"`
+		SentAt   time.Time `json:"sentAt"`
+	}
+
+	TwitchModeration struct {
+		*sync.RWMutex
+
+		rules []*TwitchModerationRule
+
+		// key: channel:username
+		recentMessages map[string][]TwitchRecentMessage
+
+		// key: api token, value: moderator
+		moderators map[string]string
+	}
+
+	TwitchRecentMessage struct {
+		content    string
+		receivedAt time.Time
+	}
+
+	TwitchModerationConfig struct {
+		// roles which are exempt from all rules without own exemptions:
+		// broadcaster, mod, vip, subscriber, founder, partner
+		Exempt []string                `json:"exempt"`
+		Rules  []*TwitchModerationRule `json:"rules"`
+	}
+
+	TwitchModerationRule struct {
+		Name string `json:"name"`
+		// banned_words, regex, links, caps, symbols, emotes, repeat or zalgo
+		Type string `json:"type"`
+		// delete, timeout, ban or warn
+		Action string `json:"action"`
+		// timeout in seconds
+		Duration int      `json:"duration"`
+		Reason   string   `json:"reason"`
+		Exempt   []string `json:"exempt"`
+
+		Words        []string `json:"words"`
+		Patterns     []string `json:"patterns"`
+		Allow        []string `json:"allow"`
+		MinLength    int      `json:"minLength"`
+		MaxRatio     float64  `json:"maxRatio"`
+		MaxEmotes    int      `json:"maxEmotes"`
+		MaxRepeats   int      `json:"maxRepeats"`
+		Window       string   `json:"window"`
+		MaxCombining int      `json:"maxCombining"`
+
+		regexps []*regexp.Regexp
+		window  time.Duration
+	}
+
+	TwitchModerationEvent struct {
+		Action string `json:"action"`
+		// filter rule, empty for actions of moderators
+		Rule     string `json:"rule"`
+		Username string `json:"username"`
+		UserID   string `json:"userID"`
+		MsgID    string `json:"msgID"`
+		// content of the deleted message
+		Content string `json:"content"`
+		// seconds for timeout and slow, minutes for followers
+		Duration int    `json:"duration"`
+		Reason   string `json:"reason"`
+		// empty for actions of the filter
+		Moderator   string `json:"moderator"`
+		ModeratorID string `json:"moderatorID"`
+		FromAutomod bool   `json:"fromAutomod"`
+	}
+
+	TwitchModeratorAction struct {
+		event      TwitchModerationEvent
+		receivedAt time.Time
+	}
+
+	// TwitchModerationAction is executed by a moderator via the http or websocket api
+	TwitchModerationAction struct {
+		// timeout, ban, unban, delete, clear, slow, followers, emoteonly, subonly or announcement
+		Action string `json:"action"`
+		// optional, actions are executed in the default channel if it is empty
+		Channel string `json:"channel"`
+		// target of timeout, ban and unban
+		Username string `json:"username"`
+		// message to delete
+		MsgID string `json:"msgID"`
+		// seconds for timeout and slow, minutes for followers
+		Duration int    `json:"duration"`
+		Reason   string `json:"reason"`
+		// turns the chat mode on or off
+		Enabled bool `json:"enabled"`
+		// text and color of announcements: blue, green, orange, purple or primary
+		Message string `json:"message"`
+		Color   string `json:"color"`
+	}
+
+	TwitchModerationActionResult struct {
+		Action     TwitchModerationAction `json:"action"`
+		Moderator  string                 `json:"moderator"`
+		Success    bool                   `json:"success"`
+		Error      string                 `json:"error,omitempty"`
+		ExecutedAt time.Time              `json:"executedAt"`
 	}
 
 	TwitchUserDetails struct {
-		ID               string `json:"_id"`
-		Username         string `json:"name"`
-		LogoURL          string `json:"logo"`
-		fetchedTimestamp time.Time
+		ID       string `json:"_id"`
+		Username string `json:"name"`
+		LogoURL  string `json:"logo"`
 	}
 
 	TwitchBadge struct {
-		ImageURL string `json:"image_url_4x"`
+		Title      string `json:"title"`
+		ImageURL1x string `json:"image_url_1x"`
+		ImageURL2x string `json:"image_url_2x"`
+		ImageURL   string `json:"image_url_4x"`
+	}
+
+	TwitchResolvedBadge struct {
+		Set     string          `json:"set"`
+		Version string          `json:"version"`
+		Title   string          `json:"title"`
+		URLs    TwitchImageURLs `json:"urls"`
 	}
 
 	TwitchEmote struct {
@@ -98,8 +502,197 @@ type (
 		} `json:"ranges"`
 	}
 
+	// TwitchMessageFragment is a part of the message content. From and to are
+	// offsets in unicode code points of the content, to is exclusive.
+	TwitchMessageFragment struct {
+		// text, emote, cheermote, mention or url
+		Type      string                   `json:"type"`
+		Text      string                   `json:"text"`
+		From      int                      `json:"from"`
+		To        int                      `json:"to"`
+		Emote     *TwitchFragmentEmote     `json:"emote,omitempty"`
+		Cheermote *TwitchFragmentCheermote `json:"cheermote,omitempty"`
+		// mentioned user
+		Username string `json:"username,omitempty"`
+		URL      string `json:"url,omitempty"`
+	}
+
+	TwitchFragmentEmote struct {
+		ID string `json:"id"`
+		// twitch, bttv, ffz or 7tv
+		Provider string          `json:"provider"`
+		URLs     TwitchImageURLs `json:"urls"`
+	}
+
+	// TwitchEmoteProvider loads third-party emotes by their code
+	TwitchEmoteProvider interface {
+		name() string
+		globalEmotes() (map[string]*TwitchFragmentEmote, error)
+		channelEmotes(channelID string) (map[string]*TwitchFragmentEmote, error)
+	}
+
+	TwitchBTTVProvider struct {
+		baseURL    string
+		httpClient *http.Client
+	}
+
+	TwitchBTTVEmote struct {
+		ID   string `json:"id"`
+		Code string `json:"code"`
+	}
+
+	TwitchFFZProvider struct {
+		baseURL    string
+		httpClient *http.Client
+	}
+
+	TwitchFFZEmoteSet struct {
+		Emoticons []struct {
+			ID   int    `json:"id"`
+			Name string `json:"name"`
+			// key: scale, 1, 2 or 4
+			URLs map[string]string `json:"urls"`
+		} `json:"emoticons"`
+	}
+
+	TwitchSevenTVProvider struct {
+		baseURL    string
+		httpClient *http.Client
+	}
+
+	TwitchSevenTVEmote struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+		Data struct {
+			Host struct {
+				URL string `json:"url"`
+			} `json:"host"`
+		} `json:"data"`
+	}
+
+	TwitchFragmentCheermote struct {
+		Prefix string `json:"prefix"`
+		Bits   int    `json:"bits"`
+		// minimum bits of the tier
+		Tier  int             `json:"tier"`
+		Color string          `json:"color"`
+		URLs  TwitchImageURLs `json:"urls"`
+	}
+
+	TwitchImageURLs struct {
+		X1 string `json:"1x"`
+		X2 string `json:"2x"`
+		X4 string `json:"4x"`
+	}
+
+	TwitchCheermote struct {
+		Prefix string                `json:"prefix"`
+		Tiers  []TwitchCheermoteTier `json:"tiers"`
+	}
+
+	TwitchCheermoteTier struct {
+		MinBits int    `json:"min_bits"`
+		Color   string `json:"color"`
+		Images  struct {
+			Dark struct {
+				// key: scale, e.g. 1, 1.5, 2, 3 or 4
+				Animated map[string]string `json:"animated"`
+			} `json:"dark"`
+		} `json:"images"`
+	}
+
+	TwitchPoll struct {
+		// poll:begin, poll:progress or poll:end
+		event      string
+		ID         string             `json:"id"`
+		Title      string             `json:"title"`
+		Status     string             `json:"status"`
+		Choices    []TwitchPollChoice `json:"choices"`
+		TotalVotes int                `json:"totalVotes"`
+		StartedAt  time.Time          `json:"startedAt"`
+		EndsAt     time.Time          `json:"endsAt"`
+		EndedAt    time.Time          `json:"endedAt"`
+	}
+
+	TwitchPollChoice struct {
+		ID         string  `json:"id"`
+		Title      string  `json:"title"`
+		Votes      int     `json:"votes"`
+		Percentage float64 `json:"percentage"`
+	}
+
+	TwitchPrediction struct {
+		// prediction:begin, prediction:progress, prediction:lock or prediction:end
+		event              string
+		ID                 string                    `json:"id"`
+		Title              string                    `json:"title"`
+		Status             string                    `json:"status"`
+		WinningOutcomeID   string                    `json:"winningOutcomeID"`
+		Outcomes           []TwitchPredictionOutcome `json:"outcomes"`
+		TotalChannelPoints int                       `json:"totalChannelPoints"`
+		TotalUsers         int                       `json:"totalUsers"`
+		StartedAt          time.Time                 `json:"startedAt"`
+		LocksAt            time.Time                 `json:"locksAt"`
+		LockedAt           time.Time                 `json:"lockedAt"`
+		EndedAt            time.Time                 `json:"endedAt"`
+	}
+
+	TwitchPredictionOutcome struct {
+		ID            string            `json:"id"`
+		Title         string            `json:"title"`
+		Color         string            `json:"color"`
+		Users         int               `json:"users"`
+		ChannelPoints int               `json:"channelPoints"`
+		Percentage    float64           `json:"percentage"`
+		TopPredictors []TwitchPredictor `json:"topPredictors"`
+	}
+
+	TwitchPredictor struct {
+		UserID            string `json:"userID"`
+		Username          string `json:"username"`
+		DisplayName       string `json:"displayName"`
+		ChannelPointsUsed int    `json:"channelPointsUsed"`
+		ChannelPointsWon  int    `json:"channelPointsWon"`
+	}
+
+	TwitchHypeTrain struct {
+		ID string `json:"id"`
+		// begin, progress, countdown or end
+		Stage            string                        `json:"stage"`
+		Level            int                           `json:"level"`
+		Total            int                           `json:"total"`
+		Progress         int                           `json:"progress"`
+		Goal             int                           `json:"goal"`
+		TopContributions []TwitchHypeTrainContribution `json:"topContributions"`
+		StartedAt        time.Time                     `json:"startedAt"`
+		ExpiresAt        time.Time                     `json:"expiresAt"`
+		SecondsLeft      int                           `json:"secondsLeft"`
+		EndedAt          time.Time                     `json:"endedAt"`
+		CooldownEndsAt   time.Time                     `json:"cooldownEndsAt"`
+
+		// key: username
+		contributors map[string]*TwitchHypeTrainContributor
+	}
+
+	TwitchHypeTrainContribution struct {
+		UserID      string `json:"userID"`
+		Username    string `json:"username"`
+		DisplayName string `json:"displayName"`
+		// bits or subscription
+		Type  string `json:"type"`
+		Total int    `json:"total"`
+	}
+
+	TwitchHypeTrainContributor struct {
+		UserID        string `json:"userID"`
+		Username      string `json:"username"`
+		Bits          int    `json:"bits"`
+		Subscriptions int    `json:"subscriptions"`
+	}
+
 	TwitchPubSub struct {
-		conn *websocket.Conn
+		conn    *websocket.Conn
+		channel *TwitchChannel
 
 		closeConn     chan bool
 		writeMessages chan *TwitchPubSubRequest
@@ -111,6 +704,32 @@ type (
 		listenMessageSent   bool
 	}
 
+	TwitchEventSub struct {
+		*sync.Mutex
+
+		enabled     bool
+		secret      string
+		callbackURL string
+		// authorized with an app access token
+		httpClient *http.Client
+
+		// key: message id
+		// value: time the message was received
+		messageIDs map[string]time.Time
+
+		// key: subscription type
+		handlers map[string]func(channel *TwitchChannel, event json.RawMessage)
+
+		// notifications waiting for the worker of the channel
+		// key: channel id
+		queues map[string]chan func()
+	}
+
+	TwitchEventSubEvent struct {
+		Type  string          `json:"type"`
+		Event json.RawMessage `json:"event"`
+	}
+
 	TwitchPubSubRequest struct {
 		Type  string                   `json:"type"`
 		Nonce string                   `json:"nonce,omitempty"`
@@ -207,6 +826,21 @@ type (
 		MultiMonthDuration   int    `json:"multi_month_duration,omitempty"`
 	}
 
+	TwitchPubSubMessageModeratorAction struct {
+		Type string `json:"type"`
+		Data struct {
+			Type             string   `json:"type"`
+			ModerationAction string   `json:"moderation_action"`
+			Args             []string `json:"args"`
+			CreatedBy        string   `json:"created_by"`
+			CreatedByUserID  string   `json:"created_by_user_id"`
+			MsgID            string   `json:"msg_id"`
+			TargetUserID     string   `json:"target_user_id"`
+			TargetUserLogin  string   `json:"target_user_login"`
+			FromAutomod      bool     `json:"from_automod"`
+		} `json:"data"`
+	}
+
 	TwitchPubSubMessageCheer struct {
 		Data struct {
 			Username         string    `json:"user_name"`
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recordUserActivity adds the activity to the statistics of the user in the data service,
+// the activities are sent in batches every steveActivitiesWindow
+func recordUserActivity(username string, userID string, activity TwitchUserActivity) {
+	steveActivities.add(SteveActivityChange{
+		Username:           username,
+		TwitchID:           userID,
+		TwitchUserActivity: activity,
+	})
+}
+
+func (activities *SteveActivities) add(change SteveActivityChange) {
+	change.Username = strings.ToLower(strings.TrimSpace(change.Username))
+	if change.Username == "" {
+		return
+	}
+	if change.SeenAt.IsZero() {
+		change.SeenAt = time.Now()
+	}
+
+	activities.Lock()
+	defer activities.Unlock()
+
+	activities.merge(change)
+
+	// the queue is only sent early while steve is reachable
+	if len(activities.changes) >= steveBalancesLimit && activities.retryDelay == 0 {
+		activities.flushLocked()
+	} else if activities.timer == nil {
+		activities.timer = time.AfterFunc(steveActivitiesWindow, activities.flush)
+	}
+}
+
+// merge adds the activity to the queued activity of the user, activities has to be locked
+func (activities *SteveActivities) merge(c SteveActivityChange) {
+	key := c.Username + ":" + strconv.Itoa(c.StreamSessionID)
+	change, ok := activities.changes[key]
+	if !ok {
+		activities.changes[key] = &c
+		return
+	}
+
+	if c.TwitchID != "" && change.TwitchID == "" {
+		change.TwitchID = c.TwitchID
+	}
+	if c.SeenAt.After(change.SeenAt) {
+		change.SeenAt = c.SeenAt
+	}
+	change.Messages += c.Messages
+	change.Commands += c.Commands
+	change.Bits += c.Bits
+	change.SubsGifted += c.SubsGifted
+	if c.MonthsSubscribed > change.MonthsSubscribed {
+		change.MonthsSubscribed = c.MonthsSubscribed
+	}
+}
+
+func (activities *SteveActivities) flush() {
+	activities.Lock()
+	defer activities.Unlock()
+
+	activities.flushLocked()
+}
+
+// flushLocked sends the queued activities, activities has to be locked
+func (activities *SteveActivities) flushLocked() {
+	changes := activities.takeLocked()
+	if len(changes) == 0 {
+		return
+	}
+
+	go func() {
+		if err := activities.send(changes); err != nil {
+			activities.retry(changes, err)
+		} else {
+			activities.Lock()
+			activities.retryDelay = 0
+			activities.Unlock()
+		}
+	}()
+}
+
+// takeLocked stops the timer and returns up to steveBalancesLimit queued activities,
+// the rest is sent after the next window, activities has to be locked
+func (activities *SteveActivities) takeLocked() []SteveActivityChange {
+	if activities.timer != nil {
+		activities.timer.Stop()
+		activities.timer = nil
+	}
+
+	var changes []SteveActivityChange
+	for key, change := range activities.changes {
+		if len(changes) == steveBalancesLimit {
+			break
+		}
+		changes = append(changes, *change)
+		delete(activities.changes, key)
+	}
+
+	if len(activities.changes) > 0 {
+		activities.timer = time.AfterFunc(steveActivitiesWindow, activities.flush)
+	}
+
+	return changes
+}
+
+// send posts the activities to steve, activities which steve skipped are logged and not retried
+func (activities *SteveActivities) send(changes []SteveActivityChange) error {
+	var results []struct {
+		Error string `json:"error"`
+	}
+	err := steveRequest(http.MethodPost, "/users/activity", changes, &results)
+	if err == errSteveBadRequest {
+		// retrying would fail again
+		log.Errorf("User activity request: %s, lost activities: %+v", err, changes)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for i, result := range results {
+		if result.Error != "" && i < len(changes) {
+			log.Errorf("User activity request: skipped activity %+v: %s", changes[i], result.Error)
+		}
+	}
+
+	return nil
+}
+
+// retry queues the failed activities again and sends them after the backoff delay
+func (activities *SteveActivities) retry(changes []SteveActivityChange, err error) {
+	activities.Lock()
+	defer activities.Unlock()
+
+	for _, change := range changes {
+		activities.merge(change)
+	}
+
+	activities.retryDelay *= 2
+	if activities.retryDelay == 0 {
+		activities.retryDelay = steveActivitiesWindow
+	} else if activities.retryDelay > steveBalancesMaxRetryDelay {
+		activities.retryDelay = steveBalancesMaxRetryDelay
+	}
+	log.Error("User activity request: ", err, ", retrying ", len(activities.changes), " activities in ", activities.retryDelay)
+
+	if activities.timer != nil {
+		activities.timer.Stop()
+	}
+	activities.timer = time.AfterFunc(activities.retryDelay, activities.flush)
+}
+
+// close sends the queued activities before ciru exits
+func (activities *SteveActivities) close() {
+	for {
+		activities.Lock()
+		changes := activities.takeLocked()
+		if activities.timer != nil {
+			activities.timer.Stop()
+			activities.timer = nil
+		}
+		activities.Unlock()
+
+		if len(changes) == 0 {
+			return
+		}
+
+		if err := activities.send(changes); err != nil {
+			log.Errorf("User activity request: %s, lost activities: %+v", err, changes)
+		}
+	}
+}
+
+// recordChatActivity counts the message and the attended stream of the user
+func (twitch *Twitch) recordChatActivity(channel *TwitchChannel, m TwitchMessage) {
+	activity := TwitchUserActivity{
+		SeenAt:           m.Timestamp,
+		Messages:         1,
+		MonthsSubscribed: int(m.User.SubscriberMonths),
+	}
+	if m.IsCommand {
+		activity.Commands = 1
+	}
+
+	channel.RLock()
+	if channel.stream != nil {
+		activity.StreamSessionID = channel.stream.SessionID
+	}
+	channel.RUnlock()
+
+	recordUserActivity(m.User.Username, m.User.ID, activity)
+}
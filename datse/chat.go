@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ChatMessage struct {
+	ID              string     `db:"id"`
+	Channel         string     `db:"channel"`
+	UserID          string     `db:"user_id"`
+	Username        string     `db:"username"`
+	DisplayName     string     `db:"display_name"`
+	Content         string     `db:"content"`
+	Command         string     `db:"command"`
+	StreamSessionID *int       `db:"stream_session_id"`
+	SentAt          time.Time  `db:"sent_at"`
+	DeletedAt       *time.Time `db:"deleted_at"`
+}
+
+type ChatTombstone struct {
+	ID        int       `db:"id"`
+	Channel   string    `db:"channel"`
+	Username  string    `db:"username"`
+	MessageID string    `db:"message_id"`
+	ClearedAt time.Time `db:"cleared_at"`
+}
+
+const chatMessageColumns = "id, channel, user_id, username, display_name, content, command, stream_session_id, sent_at, deleted_at"
+
+// /chat/messages?id={id}&channel={channel}&username={username}&q={text}&from={rfc3339}&to={rfc3339}&stream_session={id}&command={name}&commands={bool}&limit={limit}
+// All parameters are optional, q is a full-text search on the message content.
+// command filters for a specific command, commands=true returns all command usages.
+func GETChatMessages(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var (
+		conditions []string
+		args       []interface{}
+	)
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, strings.Replace(condition, "?", "$"+strconv.Itoa(len(args)), -1))
+	}
+
+	if id := strings.TrimSpace(query.Get("id")); id != "" {
+		where("id = ?", id)
+	}
+	if channel := normalizeParameter(query.Get("channel")); channel != "" {
+		where("channel = ?", channel)
+	}
+	if username := normalizeParameter(query.Get("username")); username != "" {
+		where("username = ?", username)
+	}
+	if q := strings.TrimSpace(query.Get("q")); q != "" {
+		where("to_tsvector('simple', content) @@ plainto_tsquery('simple', ?)", q)
+	}
+	for param, condition := range map[string]string{"from": "sent_at >= ?", "to": "sent_at <= ?"} {
+		if value := query.Get(param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			where(condition, t)
+		}
+	}
+	if value := query.Get("stream_session"); value != "" {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		where("stream_session_id = ?", id)
+	}
+	if command := normalizeParameter(strings.TrimPrefix(query.Get("command"), "!")); command != "" {
+		where("command = ?", command)
+	} else if commands, _ := strconv.ParseBool(query.Get("commands")); commands {
+		conditions = append(conditions, "command <> ''")
+	}
+
+	limit := 100
+	if value := query.Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > 1000 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	sql := "SELECT " + chatMessageColumns + " FROM chat_messages"
+	if len(conditions) > 0 {
+		sql += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	sql += " ORDER BY sent_at DESC LIMIT " + strconv.Itoa(limit)
+
+	messages := []ChatMessage{}
+	err := db.Select(&messages, sql, args...)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(messages)
+}
+
+// /chat/messages
+func POSTChatMessage(w http.ResponseWriter, r *http.Request) {
+	message := ChatMessage{}
+	err := json.NewDecoder(r.Body).Decode(&message)
+	message.Channel = normalizeParameter(message.Channel)
+	message.Username = normalizeParameter(message.Username)
+	message.Command = normalizeParameter(strings.TrimPrefix(message.Command, "!"))
+	if err != nil || message.ID == "" || message.Channel == "" || message.Username == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if message.SentAt.IsZero() {
+		message.SentAt = time.Now()
+	}
+
+	_, err = db.Exec("INSERT INTO chat_messages (id, channel, user_id, username, display_name, content, command, stream_session_id, sent_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT (id) DO NOTHING",
+		message.ID, message.Channel, message.UserID, message.Username, message.DisplayName, message.Content, message.Command, message.StreamSessionID, message.SentAt)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// /chat/tombstones?channel={channel}
+func GETChatTombstones(w http.ResponseWriter, r *http.Request) {
+	channel := normalizeParameter(r.URL.Query().Get("channel"))
+
+	tombstones := []ChatTombstone{}
+	err := db.Select(&tombstones, "SELECT id, channel, username, message_id, cleared_at FROM chat_tombstones WHERE $1 = '' OR channel = $1 ORDER BY cleared_at DESC LIMIT 100", channel)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(tombstones)
+}
+
+// /chat/tombstones
+// Records a clearchat (without MessageID) or clearmsg and marks the affected messages as deleted.
+// A clearchat without Username clears the whole chat.
+func POSTChatTombstone(w http.ResponseWriter, r *http.Request) {
+	tombstone := ChatTombstone{}
+	err := json.NewDecoder(r.Body).Decode(&tombstone)
+	tombstone.Channel = normalizeParameter(tombstone.Channel)
+	tombstone.Username = normalizeParameter(tombstone.Username)
+	if err != nil || tombstone.Channel == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if tombstone.ClearedAt.IsZero() {
+		tombstone.ClearedAt = time.Now()
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO chat_tombstones (channel, username, message_id, cleared_at) VALUES ($1, $2, $3, $4)",
+		tombstone.Channel, tombstone.Username, tombstone.MessageID, tombstone.ClearedAt)
+	if err == nil {
+		if tombstone.MessageID != "" {
+			_, err = tx.Exec("UPDATE chat_messages SET deleted_at = $1 WHERE id = $2 AND deleted_at IS NULL", tombstone.ClearedAt, tombstone.MessageID)
+		} else {
+			_, err = tx.Exec("UPDATE chat_messages SET deleted_at = $1 WHERE channel = $2 AND ($3 = '' OR username = $3) AND sent_at <= $1 AND deleted_at IS NULL",
+				tombstone.ClearedAt, tombstone.Channel, tombstone.Username)
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type Follow struct {
+	Channel          string    `db:"channel"`
+	UserID           string    `db:"user_id"`
+	Username         string    `db:"username"`
+	FollowedAt       time.Time `db:"followed_at"`
+	Taler            int       `db:"taler"`
+	ReputationPoints int       `db:"reputation_points"`
+}
+
+// /follow?channel={channel}
+func GETFollows(w http.ResponseWriter, r *http.Request) {
+	channel := normalizeParameter(r.URL.Query().Get("channel"))
+
+	follows := []Follow{}
+	err := db.Select(&follows, "SELECT channel, user_id, username, followed_at, taler, reputation_points FROM follows WHERE $1 = '' OR channel = $1 ORDER BY followed_at DESC LIMIT 10", channel)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(follows)
+}
+
+// /follow
+// Records a follow, the taler and reputation points are only given
+// to the user if they never followed the channel before.
+func POSTFollow(w http.ResponseWriter, r *http.Request) {
+	follow := Follow{}
+	err := json.NewDecoder(r.Body).Decode(&follow)
+	follow.Channel = normalizeParameter(follow.Channel)
+	follow.Username = normalizeParameter(follow.Username)
+	if err != nil || follow.Channel == "" || follow.UserID == "" || follow.Username == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if follow.FollowedAt.IsZero() {
+		follow.FollowedAt = time.Now()
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO follows (channel, user_id, username, followed_at, taler, reputation_points) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (channel, user_id) DO NOTHING",
+		follow.Channel, follow.UserID, follow.Username, follow.FollowedAt, follow.Taler, follow.ReputationPoints)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	rows, _ := res.RowsAffected()
+	firstTime := rows > 0
+
+	if firstTime {
+		var username string
+		username, err = resolveUsername(tx, follow.Username, follow.UserID)
+		if err == nil {
+			err = addToBalance(tx, username, "taler", follow.Taler)
+		}
+		if err == nil {
+			err = addToBalance(tx, username, "reputation_points", follow.ReputationPoints)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Error(err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(struct {
+		FirstTime bool
+	}{
+		FirstTime: firstTime,
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type HypeTrain struct {
+	ID           string    `db:"id"`
+	Channel      string    `db:"channel"`
+	Level        int       `db:"level"`
+	Total        int       `db:"total"`
+	StartedAt    time.Time `db:"started_at"`
+	EndedAt      time.Time `db:"ended_at"`
+	Contributors []HypeTrainContributor
+}
+
+type HypeTrainContributor struct {
+	Username      string `db:"username"`
+	UserID        string `db:"user_id"`
+	Bits          int    `db:"bits"`
+	Subscriptions int    `db:"subscriptions"`
+	Taler         int    `db:"taler"`
+}
+
+// /hype_train?channel={channel}
+func GETHypeTrains(w http.ResponseWriter, r *http.Request) {
+	channel := normalizeParameter(r.URL.Query().Get("channel"))
+
+	hypeTrains := []HypeTrain{}
+	err := db.Select(&hypeTrains, "SELECT id, channel, level, total, started_at, ended_at FROM hype_trains WHERE $1 = '' OR channel = $1 ORDER BY started_at DESC LIMIT 10", channel)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	for i := range hypeTrains {
+		hypeTrains[i].Contributors = []HypeTrainContributor{}
+		err := db.Select(&hypeTrains[i].Contributors, "SELECT username, user_id, bits, subscriptions, taler FROM hype_train_contributors WHERE hype_train_id = $1 ORDER BY bits + subscriptions DESC", hypeTrains[i].ID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Error(err)
+			return
+		}
+	}
+
+	json.NewEncoder(w).Encode(hypeTrains)
+}
+
+// /hype_train
+// Records a finished hype train. Every contributor gets a team bonus
+// of NSE_HYPE_TRAIN_TALER_PER_LEVEL taler for each reached level.
+func POSTHypeTrain(w http.ResponseWriter, r *http.Request) {
+	hypeTrain := HypeTrain{}
+	err := json.NewDecoder(r.Body).Decode(&hypeTrain)
+	hypeTrain.Channel = normalizeParameter(hypeTrain.Channel)
+	if err != nil || hypeTrain.ID == "" || hypeTrain.Channel == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO hype_trains (id, channel, level, total, started_at, ended_at) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (id) DO NOTHING",
+		hypeTrain.ID, hypeTrain.Channel, hypeTrain.Level, hypeTrain.Total, hypeTrain.StartedAt, hypeTrain.EndedAt)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	// the hype train was already recorded and paid out
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return
+	}
+
+	bonus := hypeTrain.Level * envInt("NSE_HYPE_TRAIN_TALER_PER_LEVEL", 0)
+	for _, contributor := range hypeTrain.Contributors {
+		username := normalizeParameter(contributor.Username)
+		if username == "" {
+			continue
+		}
+
+		_, err = tx.Exec("INSERT INTO hype_train_contributors (hype_train_id, username, user_id, bits, subscriptions, taler) VALUES ($1, $2, $3, $4, $5, $6)",
+			hypeTrain.ID, username, contributor.UserID, contributor.Bits, contributor.Subscriptions, bonus)
+		if err == nil && bonus > 0 {
+			username, err = resolveUsername(tx, username, contributor.UserID)
+			if err == nil {
+				err = addToBalance(tx, username, "taler", bonus)
+			}
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Error(err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+	}
+}
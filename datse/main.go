@@ -3,6 +3,7 @@ package main
 import (
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -39,10 +40,14 @@ func main() {
 
 	// user endpoints
 	r.HandleFunc("/user", GETUsers).Methods("GET")
+	r.HandleFunc("/user", POSTUser).Methods("POST")
 	r.HandleFunc("/user/{username}", GETUser).Methods("GET")
 	r.HandleFunc("/user/{username}", PUTUser).Methods("PUT")
-	r.HandleFunc("/user/{username}/taler", PUTUser).Methods("PUT")
-	r.HandleFunc("/user/{username}/reputation_points", PUTUser).Methods("PUT")
+	r.HandleFunc("/user/{username}/{sub_target}", PUTUser).Methods("PUT")
+	r.HandleFunc("/user/{username}/merge", POSTUserMerge).Methods("POST")
+	r.HandleFunc("/users/lookup", POSTUsersLookup).Methods("POST")
+	r.HandleFunc("/users/balances", POSTUsersBalances).Methods("POST")
+	r.HandleFunc("/users/activity", POSTUsersActivity).Methods("POST")
 
 	// command endpoints
 	r.HandleFunc("/command", GETCommands).Methods("GET")
@@ -50,6 +55,40 @@ func main() {
 	r.HandleFunc("/command/{name}", PUTCommand).Methods("PUT")
 	r.HandleFunc("/command/{name}/{sub_target}", PUTCommand).Methods("PUT")
 
+	// stream session endpoints
+	r.HandleFunc("/stream_session", GETStreamSessions).Methods("GET")
+	r.HandleFunc("/stream_session", POSTStreamSession).Methods("POST")
+	r.HandleFunc("/stream_session/{id}", GETStreamSession).Methods("GET")
+	r.HandleFunc("/stream_session/{id}", PUTStreamSession).Methods("PUT")
+	r.HandleFunc("/stream_session/{id}/end", PUTStreamSessionEnd).Methods("PUT")
+	r.HandleFunc("/stream_session/{id}/sample", POSTStreamSessionSample).Methods("POST")
+
+	// follow and raid endpoints
+	r.HandleFunc("/follow", GETFollows).Methods("GET")
+	r.HandleFunc("/follow", POSTFollow).Methods("POST")
+	r.HandleFunc("/raid", GETRaids).Methods("GET")
+	r.HandleFunc("/raid", POSTRaid).Methods("POST")
+
+	// poll and prediction endpoints
+	r.HandleFunc("/poll", GETPolls).Methods("GET")
+	r.HandleFunc("/poll", POSTPoll).Methods("POST")
+	r.HandleFunc("/prediction", GETPredictions).Methods("GET")
+	r.HandleFunc("/prediction", POSTPrediction).Methods("POST")
+
+	// hype train endpoints
+	r.HandleFunc("/hype_train", GETHypeTrains).Methods("GET")
+	r.HandleFunc("/hype_train", POSTHypeTrain).Methods("POST")
+
+	// chat log endpoints
+	r.HandleFunc("/chat/messages", GETChatMessages).Methods("GET")
+	r.HandleFunc("/chat/messages", POSTChatMessage).Methods("POST")
+	r.HandleFunc("/chat/tombstones", GETChatTombstones).Methods("GET")
+	r.HandleFunc("/chat/tombstones", POSTChatTombstone).Methods("POST")
+
+	// moderation log endpoints
+	r.HandleFunc("/moderation/actions", GETModerationActions).Methods("GET")
+	r.HandleFunc("/moderation/actions", POSTModerationAction).Methods("POST")
+
 	// automatic message(s) endpoints
 	r.HandleFunc("/automatic_message", GETAutomaticMessages).Methods("GET")
 
@@ -63,3 +102,12 @@ func main() {
 func normalizeParameter(username string) string {
 	return strings.TrimSpace(strings.ToLower(username))
 }
+
+// envInt returns the env var as int or def if it is not set or invalid
+func envInt(name string, def int) int {
+	if i, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return i
+	}
+
+	return def
+}
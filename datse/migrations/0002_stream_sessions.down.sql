@@ -0,0 +1,3 @@
+DROP TABLE stream_session_changes;
+DROP TABLE stream_session_samples;
+DROP TABLE stream_sessions;
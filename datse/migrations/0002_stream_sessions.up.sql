@@ -0,0 +1,32 @@
+CREATE TABLE stream_sessions
+(
+    id SERIAL NOT NULL,
+    channel character varying(100) NOT NULL,
+    stream_id character varying(50) NOT NULL,
+    title character varying(500) DEFAULT '',
+    game character varying(200) DEFAULT '',
+    started_at timestamp with time zone NOT NULL,
+    ended_at timestamp with time zone,
+    peak_viewers integer DEFAULT 0,
+    avg_viewers integer DEFAULT 0,
+    CONSTRAINT stream_sessions_pkey PRIMARY KEY (id),
+    CONSTRAINT stream_sessions_channel_stream_id_key UNIQUE (channel, stream_id)
+);
+
+CREATE TABLE stream_session_samples
+(
+    session_id integer NOT NULL REFERENCES stream_sessions (id) ON DELETE CASCADE,
+    sampled_at timestamp with time zone NOT NULL DEFAULT now(),
+    viewers integer NOT NULL,
+    CONSTRAINT stream_session_samples_pkey PRIMARY KEY (session_id, sampled_at)
+);
+
+CREATE TABLE stream_session_changes
+(
+    id SERIAL NOT NULL,
+    session_id integer NOT NULL REFERENCES stream_sessions (id) ON DELETE CASCADE,
+    changed_at timestamp with time zone NOT NULL DEFAULT now(),
+    title character varying(500) DEFAULT '',
+    game character varying(200) DEFAULT '',
+    CONSTRAINT stream_session_changes_pkey PRIMARY KEY (id)
+);
@@ -0,0 +1,2 @@
+DROP TABLE raids;
+DROP TABLE follows;
@@ -0,0 +1,23 @@
+CREATE TABLE follows
+(
+    channel character varying(100) NOT NULL,
+    user_id character varying(50) NOT NULL,
+    username character varying(100) NOT NULL,
+    followed_at timestamp with time zone NOT NULL,
+    taler integer DEFAULT 0,
+    reputation_points integer DEFAULT 0,
+    CONSTRAINT follows_pkey PRIMARY KEY (channel, user_id)
+);
+
+CREATE TABLE raids
+(
+    id SERIAL NOT NULL,
+    channel character varying(100) NOT NULL,
+    from_user_id character varying(50) NOT NULL,
+    from_username character varying(100) NOT NULL,
+    viewers integer NOT NULL,
+    raided_at timestamp with time zone NOT NULL DEFAULT now(),
+    taler integer DEFAULT 0,
+    reputation_points integer DEFAULT 0,
+    CONSTRAINT raids_pkey PRIMARY KEY (id)
+);
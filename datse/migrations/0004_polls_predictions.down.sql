@@ -0,0 +1,3 @@
+DROP TABLE prediction_payouts;
+DROP TABLE predictions;
+DROP TABLE polls;
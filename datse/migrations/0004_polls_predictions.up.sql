@@ -0,0 +1,35 @@
+CREATE TABLE polls
+(
+    id character varying(50) NOT NULL,
+    channel character varying(100) NOT NULL,
+    title character varying(200) DEFAULT '',
+    status character varying(30) DEFAULT '',
+    choices jsonb NOT NULL DEFAULT '[]',
+    started_at timestamp with time zone NOT NULL,
+    ended_at timestamp with time zone NOT NULL,
+    CONSTRAINT polls_pkey PRIMARY KEY (id)
+);
+
+CREATE TABLE predictions
+(
+    id character varying(50) NOT NULL,
+    channel character varying(100) NOT NULL,
+    title character varying(200) DEFAULT '',
+    status character varying(30) DEFAULT '',
+    winning_outcome_id character varying(50) DEFAULT '',
+    total_channel_points integer DEFAULT 0,
+    outcomes jsonb NOT NULL DEFAULT '[]',
+    started_at timestamp with time zone NOT NULL,
+    ended_at timestamp with time zone NOT NULL,
+    CONSTRAINT predictions_pkey PRIMARY KEY (id)
+);
+
+CREATE TABLE prediction_payouts
+(
+    prediction_id character varying(50) NOT NULL REFERENCES predictions (id) ON DELETE CASCADE,
+    username character varying(100) NOT NULL,
+    channel_points_used integer NOT NULL,
+    channel_points_won integer NOT NULL,
+    taler integer NOT NULL,
+    CONSTRAINT prediction_payouts_pkey PRIMARY KEY (prediction_id, username)
+);
@@ -0,0 +1,2 @@
+DROP TABLE hype_train_contributors;
+DROP TABLE hype_trains;
@@ -0,0 +1,21 @@
+CREATE TABLE hype_trains
+(
+    id character varying(50) NOT NULL,
+    channel character varying(100) NOT NULL,
+    level integer NOT NULL,
+    total integer NOT NULL,
+    started_at timestamp with time zone NOT NULL,
+    ended_at timestamp with time zone NOT NULL,
+    CONSTRAINT hype_trains_pkey PRIMARY KEY (id)
+);
+
+CREATE TABLE hype_train_contributors
+(
+    hype_train_id character varying(50) NOT NULL REFERENCES hype_trains (id) ON DELETE CASCADE,
+    username character varying(100) NOT NULL,
+    user_id character varying(50) DEFAULT '',
+    bits integer DEFAULT 0,
+    subscriptions integer DEFAULT 0,
+    taler integer DEFAULT 0,
+    CONSTRAINT hype_train_contributors_pkey PRIMARY KEY (hype_train_id, username)
+);
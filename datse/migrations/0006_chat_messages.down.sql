@@ -0,0 +1,2 @@
+DROP TABLE chat_tombstones;
+DROP TABLE chat_messages;
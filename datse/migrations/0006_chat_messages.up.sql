@@ -0,0 +1,32 @@
+CREATE TABLE chat_messages
+(
+    id character varying(50) NOT NULL,
+    channel character varying(100) NOT NULL,
+    user_id character varying(50) DEFAULT '',
+    username character varying(100) NOT NULL,
+    display_name character varying(100) DEFAULT '',
+    content text NOT NULL,
+    command character varying(100) DEFAULT '',
+    stream_session_id integer REFERENCES stream_sessions (id) ON DELETE SET NULL,
+    sent_at timestamp with time zone NOT NULL,
+    deleted_at timestamp with time zone,
+    CONSTRAINT chat_messages_pkey PRIMARY KEY (id)
+);
+
+CREATE INDEX chat_messages_content_idx ON chat_messages USING GIN (to_tsvector('simple', content));
+CREATE INDEX chat_messages_channel_sent_at_idx ON chat_messages (channel, sent_at);
+CREATE INDEX chat_messages_username_idx ON chat_messages (username);
+CREATE INDEX chat_messages_stream_session_id_idx ON chat_messages (stream_session_id);
+
+-- clearchat (message_id is empty) and clearmsg events
+CREATE TABLE chat_tombstones
+(
+    id SERIAL NOT NULL,
+    channel character varying(100) NOT NULL,
+    username character varying(100) DEFAULT '',
+    message_id character varying(50) DEFAULT '',
+    cleared_at timestamp with time zone NOT NULL DEFAULT now(),
+    CONSTRAINT chat_tombstones_pkey PRIMARY KEY (id)
+);
+
+CREATE INDEX chat_tombstones_channel_cleared_at_idx ON chat_tombstones (channel, cleared_at);
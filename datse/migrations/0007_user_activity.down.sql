@@ -0,0 +1,11 @@
+DROP TABLE user_stream_sessions;
+
+ALTER TABLE users
+    DROP COLUMN first_seen,
+    DROP COLUMN last_seen,
+    DROP COLUMN message_count,
+    DROP COLUMN command_count,
+    DROP COLUMN streams_attended,
+    DROP COLUMN bits_total,
+    DROP COLUMN subs_gifted,
+    DROP COLUMN months_subscribed;
@@ -0,0 +1,16 @@
+ALTER TABLE users
+    ADD COLUMN first_seen timestamp with time zone,
+    ADD COLUMN last_seen timestamp with time zone,
+    ADD COLUMN message_count integer DEFAULT 0,
+    ADD COLUMN command_count integer DEFAULT 0,
+    ADD COLUMN streams_attended integer DEFAULT 0,
+    ADD COLUMN bits_total integer DEFAULT 0,
+    ADD COLUMN subs_gifted integer DEFAULT 0,
+    ADD COLUMN months_subscribed integer DEFAULT 0;
+
+CREATE TABLE user_stream_sessions
+(
+    username character varying(100) NOT NULL REFERENCES users (username) ON DELETE CASCADE ON UPDATE CASCADE,
+    stream_session_id integer NOT NULL REFERENCES stream_sessions (id) ON DELETE CASCADE,
+    CONSTRAINT user_stream_sessions_pkey PRIMARY KEY (username, stream_session_id)
+);
@@ -0,0 +1,5 @@
+DROP TABLE user_name_history;
+
+DROP INDEX users_twitch_id_idx;
+
+ALTER TABLE users DROP COLUMN twitch_id;
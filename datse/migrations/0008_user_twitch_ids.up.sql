@@ -0,0 +1,11 @@
+ALTER TABLE users ADD COLUMN twitch_id character varying(50);
+
+CREATE UNIQUE INDEX users_twitch_id_idx ON users (twitch_id);
+
+CREATE TABLE user_name_history
+(
+    twitch_id character varying(50) NOT NULL,
+    username character varying(100) NOT NULL,
+    changed_at timestamp with time zone NOT NULL DEFAULT now(),
+    CONSTRAINT user_name_history_pkey PRIMARY KEY (twitch_id, username)
+);
@@ -0,0 +1,21 @@
+-- actions of moderators via the moderation api of ciru
+CREATE TABLE moderation_actions
+(
+    id SERIAL NOT NULL,
+    channel character varying(100) NOT NULL,
+    moderator character varying(100) NOT NULL,
+    action character varying(50) NOT NULL,
+    username character varying(100) DEFAULT '',
+    message_id character varying(50) DEFAULT '',
+    duration integer DEFAULT 0,
+    enabled boolean DEFAULT false,
+    reason text DEFAULT '',
+    message text DEFAULT '',
+    success boolean NOT NULL,
+    error text DEFAULT '',
+    executed_at timestamp with time zone NOT NULL DEFAULT now(),
+    CONSTRAINT moderation_actions_pkey PRIMARY KEY (id)
+);
+
+CREATE INDEX moderation_actions_channel_executed_at_idx ON moderation_actions (channel, executed_at);
+CREATE INDEX moderation_actions_username_idx ON moderation_actions (username);
@@ -0,0 +1,3 @@
+DROP INDEX raids_channel_from_user_id_bucket_idx;
+
+ALTER TABLE raids DROP COLUMN bucket;
@@ -0,0 +1,4 @@
+-- raids are reported by IRC and EventSub, only one raid per raider and bucket is recorded
+ALTER TABLE raids ADD COLUMN bucket bigint;
+
+CREATE UNIQUE INDEX raids_channel_from_user_id_bucket_idx ON raids (channel, from_user_id, bucket);
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type ModerationAction struct {
+	ID         int       `db:"id"`
+	Channel    string    `db:"channel"`
+	Moderator  string    `db:"moderator"`
+	Action     string    `db:"action"`
+	Username   string    `db:"username"`
+	MessageID  string    `db:"message_id"`
+	Duration   int       `db:"duration"`
+	Enabled    bool      `db:"enabled"`
+	Reason     string    `db:"reason"`
+	Message    string    `db:"message"`
+	Success    bool      `db:"success"`
+	Error      string    `db:"error"`
+	ExecutedAt time.Time `db:"executed_at"`
+}
+
+// /moderation/actions?channel={channel}&moderator={moderator}&username={username}&limit={limit}
+// All parameters are optional, username filters for actions against the user.
+func GETModerationActions(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit := 100
+	if value := query.Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > 1000 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	actions := []ModerationAction{}
+	err := db.Select(&actions, "SELECT id, channel, moderator, action, username, message_id, duration, enabled, reason, message, success, error, executed_at FROM moderation_actions WHERE ($1 = '' OR channel = $1) AND ($2 = '' OR moderator = $2) AND ($3 = '' OR username = $3) ORDER BY executed_at DESC LIMIT $4",
+		normalizeParameter(query.Get("channel")), normalizeParameter(query.Get("moderator")), normalizeParameter(query.Get("username")), limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(actions)
+}
+
+// /moderation/actions
+func POSTModerationAction(w http.ResponseWriter, r *http.Request) {
+	action := ModerationAction{}
+	err := json.NewDecoder(r.Body).Decode(&action)
+	action.Channel = normalizeParameter(action.Channel)
+	action.Moderator = normalizeParameter(action.Moderator)
+	action.Username = normalizeParameter(action.Username)
+	if err != nil || action.Channel == "" || action.Moderator == "" || action.Action == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if action.ExecutedAt.IsZero() {
+		action.ExecutedAt = time.Now()
+	}
+
+	_, err = db.Exec("INSERT INTO moderation_actions (channel, moderator, action, username, message_id, duration, enabled, reason, message, success, error, executed_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)",
+		action.Channel, action.Moderator, action.Action, action.Username, action.MessageID, action.Duration, action.Enabled, action.Reason, action.Message, action.Success, action.Error, action.ExecutedAt)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+)
+
+type Poll struct {
+	ID        string         `db:"id"`
+	Channel   string         `db:"channel"`
+	Title     string         `db:"title"`
+	Status    string         `db:"status"`
+	Choices   types.JSONText `db:"choices"`
+	StartedAt time.Time      `db:"started_at"`
+	EndedAt   time.Time      `db:"ended_at"`
+}
+
+// /poll?channel={channel}
+func GETPolls(w http.ResponseWriter, r *http.Request) {
+	channel := normalizeParameter(r.URL.Query().Get("channel"))
+
+	polls := []Poll{}
+	err := db.Select(&polls, "SELECT id, channel, title, status, choices, started_at, ended_at FROM polls WHERE $1 = '' OR channel = $1 ORDER BY started_at DESC LIMIT 10", channel)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(polls)
+}
+
+// /poll
+func POSTPoll(w http.ResponseWriter, r *http.Request) {
+	poll := Poll{}
+	err := json.NewDecoder(r.Body).Decode(&poll)
+	poll.Channel = normalizeParameter(poll.Channel)
+	if err != nil || poll.ID == "" || poll.Channel == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if len(poll.Choices) == 0 {
+		poll.Choices = types.JSONText("[]")
+	}
+
+	_, err = db.Exec(`INSERT INTO polls (id, channel, title, status, choices, started_at, ended_at) VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (id) DO UPDATE SET status = $4, choices = $5, ended_at = $7`,
+		poll.ID, poll.Channel, poll.Title, poll.Status, poll.Choices, poll.StartedAt, poll.EndedAt)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+)
+
+type Prediction struct {
+	ID                 string         `db:"id"`
+	Channel            string         `db:"channel"`
+	Title              string         `db:"title"`
+	Status             string         `db:"status"`
+	WinningOutcomeID   string         `db:"winning_outcome_id"`
+	TotalChannelPoints int            `db:"total_channel_points"`
+	Outcomes           types.JSONText `db:"outcomes"`
+	StartedAt          time.Time      `db:"started_at"`
+	EndedAt            time.Time      `db:"ended_at"`
+	Payouts            []PredictionPayout
+}
+
+type PredictionPayout struct {
+	Username          string `db:"username"`
+	ChannelPointsUsed int    `db:"channel_points_used"`
+	ChannelPointsWon  int    `db:"channel_points_won"`
+	Taler             int    `db:"taler"`
+}
+
+// /prediction?channel={channel}
+func GETPredictions(w http.ResponseWriter, r *http.Request) {
+	channel := normalizeParameter(r.URL.Query().Get("channel"))
+
+	predictions := []Prediction{}
+	err := db.Select(&predictions, "SELECT id, channel, title, status, winning_outcome_id, total_channel_points, outcomes, started_at, ended_at FROM predictions WHERE $1 = '' OR channel = $1 ORDER BY started_at DESC LIMIT 10", channel)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	for i := range predictions {
+		predictions[i].Payouts = []PredictionPayout{}
+		err := db.Select(&predictions[i].Payouts, "SELECT username, channel_points_used, channel_points_won, taler FROM prediction_payouts WHERE prediction_id = $1 ORDER BY taler DESC", predictions[i].ID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Error(err)
+			return
+		}
+	}
+
+	json.NewEncoder(w).Encode(predictions)
+}
+
+// /prediction
+// Records the outcome of a prediction. If NSE_PREDICTION_TALER_RATIO is set the winners get
+// taler proportional to the channel points they used. Twitch only reports the top predictors
+// of each outcome, so only those are paid out.
+func POSTPrediction(w http.ResponseWriter, r *http.Request) {
+	prediction := Prediction{}
+	err := json.NewDecoder(r.Body).Decode(&prediction)
+	prediction.Channel = normalizeParameter(prediction.Channel)
+	if err != nil || prediction.ID == "" || prediction.Channel == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if len(prediction.Outcomes) == 0 {
+		prediction.Outcomes = types.JSONText("[]")
+	}
+
+	var outcomes []struct {
+		ID            string
+		TopPredictors []struct {
+			UserID            string
+			Username          string
+			ChannelPointsUsed int
+			ChannelPointsWon  int
+		}
+	}
+	err = prediction.Outcomes.Unmarshal(&outcomes)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`INSERT INTO predictions (id, channel, title, status, winning_outcome_id, total_channel_points, outcomes, started_at, ended_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (id) DO NOTHING`,
+		prediction.ID, prediction.Channel, prediction.Title, prediction.Status, prediction.WinningOutcomeID, prediction.TotalChannelPoints, prediction.Outcomes, prediction.StartedAt, prediction.EndedAt)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	// the prediction was already recorded and paid out
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return
+	}
+
+	ratio, _ := strconv.ParseFloat(os.Getenv("NSE_PREDICTION_TALER_RATIO"), 64)
+	if ratio > 0 && prediction.Status == "resolved" {
+		for _, outcome := range outcomes {
+			if outcome.ID != prediction.WinningOutcomeID {
+				continue
+			}
+
+			for _, predictor := range outcome.TopPredictors {
+				username := normalizeParameter(predictor.Username)
+				taler := int(float64(predictor.ChannelPointsUsed) * ratio)
+				if username == "" || taler <= 0 {
+					continue
+				}
+
+				// the predictor may have been renamed since the last payout
+				username, err = resolveUsername(tx, username, predictor.UserID)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					log.Error(err)
+					return
+				}
+
+				_, err = tx.Exec("INSERT INTO prediction_payouts (prediction_id, username, channel_points_used, channel_points_won, taler) VALUES ($1, $2, $3, $4, $5)",
+					prediction.ID, username, predictor.ChannelPointsUsed, predictor.ChannelPointsWon, taler)
+				if err == nil {
+					err = addToBalance(tx, username, "taler", taler)
+				}
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					log.Error(err)
+					return
+				}
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+	}
+}
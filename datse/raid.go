@@ -0,0 +1,99 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// raids of the same raider within a bucket are duplicates
+const raidBucket = 10 * time.Minute
+
+type Raid struct {
+	ID               int       `db:"id"`
+	Channel          string    `db:"channel"`
+	FromUserID       string    `db:"from_user_id"`
+	FromUsername     string    `db:"from_username"`
+	Viewers          int       `db:"viewers"`
+	RaidedAt         time.Time `db:"raided_at"`
+	Taler            int       `db:"taler"`
+	ReputationPoints int       `db:"reputation_points"`
+}
+
+// /raid?channel={channel}
+func GETRaids(w http.ResponseWriter, r *http.Request) {
+	channel := normalizeParameter(r.URL.Query().Get("channel"))
+
+	raids := []Raid{}
+	err := db.Select(&raids, "SELECT id, channel, from_user_id, from_username, viewers, raided_at, taler, reputation_points FROM raids WHERE $1 = '' OR channel = $1 ORDER BY raided_at DESC LIMIT 10", channel)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(raids)
+}
+
+// /raid
+// Records a raid and gives the taler and reputation points to the raiding broadcaster.
+// A raid which was already recorded within the same bucket is returned without reward.
+func POSTRaid(w http.ResponseWriter, r *http.Request) {
+	raid := Raid{}
+	err := json.NewDecoder(r.Body).Decode(&raid)
+	raid.Channel = normalizeParameter(raid.Channel)
+	raid.FromUsername = normalizeParameter(raid.FromUsername)
+	if err != nil || raid.Channel == "" || raid.FromUserID == "" || raid.FromUsername == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+	defer tx.Rollback()
+
+	bucket := time.Now().Unix() / int64(raidBucket/time.Second)
+	err = tx.Get(&raid, `INSERT INTO raids (channel, from_user_id, from_username, viewers, taler, reputation_points, bucket) VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (channel, from_user_id, bucket) DO NOTHING
+		RETURNING id, channel, from_user_id, from_username, viewers, raided_at, taler, reputation_points`,
+		raid.Channel, raid.FromUserID, raid.FromUsername, raid.Viewers, raid.Taler, raid.ReputationPoints, bucket)
+	// the raid was already recorded, e.g. it was reported by IRC and EventSub
+	if err == sql.ErrNoRows {
+		err = tx.Get(&raid, "SELECT id, channel, from_user_id, from_username, viewers, raided_at, taler, reputation_points FROM raids WHERE channel = $1 AND from_user_id = $2 AND bucket = $3",
+			raid.Channel, raid.FromUserID, bucket)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Error(err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(raid)
+		return
+	}
+
+	username := raid.FromUsername
+	if err == nil {
+		username, err = resolveUsername(tx, username, raid.FromUserID)
+	}
+	if err == nil {
+		err = addToBalance(tx, username, "taler", raid.Taler)
+	}
+	if err == nil {
+		err = addToBalance(tx, username, "reputation_points", raid.ReputationPoints)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(raid)
+}
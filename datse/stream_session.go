@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type StreamSession struct {
+	ID          int        `db:"id"`
+	Channel     string     `db:"channel"`
+	StreamID    string     `db:"stream_id"`
+	Title       string     `db:"title"`
+	Game        string     `db:"game"`
+	StartedAt   time.Time  `db:"started_at"`
+	EndedAt     *time.Time `db:"ended_at"`
+	PeakViewers int        `db:"peak_viewers"`
+	AvgViewers  int        `db:"avg_viewers"`
+	Changes     []StreamSessionChange
+}
+
+type StreamSessionChange struct {
+	ChangedAt time.Time `db:"changed_at"`
+	Title     string    `db:"title"`
+	Game      string    `db:"game"`
+}
+
+const streamSessionColumns = "id, channel, stream_id, title, game, started_at, ended_at, peak_viewers, avg_viewers"
+
+// /stream_session
+// /stream_session?channel={channel}
+func GETStreamSessions(w http.ResponseWriter, r *http.Request) {
+	channel := normalizeParameter(r.URL.Query().Get("channel"))
+
+	sessions := []StreamSession{}
+	err := db.Select(&sessions, "SELECT "+streamSessionColumns+" FROM stream_sessions WHERE $1 = '' OR channel = $1 ORDER BY started_at DESC LIMIT 10", channel)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// /stream_session/{id}
+func GETStreamSession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	session := StreamSession{}
+	err = db.Get(&session, "SELECT "+streamSessionColumns+" FROM stream_sessions WHERE id = $1", id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		log.Error(err)
+		return
+	}
+
+	session.Changes = []StreamSessionChange{}
+	err = db.Select(&session.Changes, "SELECT changed_at, title, game FROM stream_session_changes WHERE session_id = $1 ORDER BY changed_at", id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(session)
+}
+
+// /stream_session
+// Starts a new session or returns the existing one if the stream was already recorded.
+func POSTStreamSession(w http.ResponseWriter, r *http.Request) {
+	session := StreamSession{}
+	err := json.NewDecoder(r.Body).Decode(&session)
+	session.Channel = normalizeParameter(session.Channel)
+	if err != nil || session.Channel == "" || session.StreamID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if session.StartedAt.IsZero() {
+		session.StartedAt = time.Now()
+	}
+
+	err = db.Get(&session, `INSERT INTO stream_sessions (channel, stream_id, title, game, started_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (channel, stream_id) DO UPDATE SET ended_at = NULL
+		RETURNING `+streamSessionColumns, session.Channel, session.StreamID, session.Title, session.Game, session.StartedAt)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(session)
+}
+
+// /stream_session/{id}
+// Records a title or game change.
+func PUTStreamSession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	change := StreamSessionChange{}
+	err = json.NewDecoder(r.Body).Decode(&change)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE stream_sessions SET title = $2, game = $3 WHERE id = $1", id, change.Title, change.Game)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	_, err = tx.Exec("INSERT INTO stream_session_changes (session_id, title, game) VALUES ($1, $2, $3)", id, change.Title, change.Game)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+	}
+}
+
+// /stream_session/{id}/end
+func PUTStreamSessionEnd(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	res, err := db.Exec("UPDATE stream_sessions SET ended_at = now() WHERE id = $1 AND ended_at IS NULL", id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// /stream_session/{id}/sample?viewers={viewers}
+func POSTStreamSessionSample(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	viewers, err := strconv.Atoi(r.URL.Query().Get("viewers"))
+	if err != nil || viewers < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO stream_session_samples (session_id, viewers) VALUES ($1, $2)", id, viewers)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		log.Error(err)
+		return
+	}
+
+	_, err = tx.Exec(`UPDATE stream_sessions SET
+		peak_viewers = GREATEST(peak_viewers, $2),
+		avg_viewers = (SELECT ROUND(AVG(viewers)) FROM stream_session_samples WHERE session_id = $1)
+		WHERE id = $1`, id, viewers)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+	}
+}
@@ -1,24 +1,60 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
 )
 
 type User struct {
-	Username         string `db:"username"`
-	Status           string `db:"status"`
-	Team             string `db:"team"`
-	Taler            int    `db:"taler"`
-	ReputationPoints int    `db:"reputation_points"`
+	Username         string     `db:"username"`
+	TwitchID         *string    `db:"twitch_id"`
+	Status           string     `db:"status"`
+	Team             string     `db:"team"`
+	Taler            int        `db:"taler"`
+	ReputationPoints int        `db:"reputation_points"`
+	FirstSeen        *time.Time `db:"first_seen"`
+	LastSeen         *time.Time `db:"last_seen"`
+	MessageCount     int        `db:"message_count"`
+	CommandCount     int        `db:"command_count"`
+	StreamsAttended  int        `db:"streams_attended"`
+	BitsTotal        int        `db:"bits_total"`
+	SubsGifted       int        `db:"subs_gifted"`
+	MonthsSubscribed int        `db:"months_subscribed"`
+	UsernameHistory  []UsernameChange
 }
 
+type UsernameChange struct {
+	Username  string    `db:"username"`
+	ChangedAt time.Time `db:"changed_at"`
+}
+
+// UserActivity contains the amounts which are added to the statistics of the user
+type UserActivity struct {
+	SeenAt          time.Time
+	Messages        int
+	Commands        int
+	StreamSessionID int
+	Bits            int
+	SubsGifted      int
+	// only replaces the current value if it is higher
+	MonthsSubscribed int
+}
+
+const userColumns = "username, twitch_id, status, team, taler, reputation_points, first_seen, last_seen, message_count, command_count, streams_attended, bits_total, subs_gifted, months_subscribed"
+
 // /user
 func GETUsers(w http.ResponseWriter, r *http.Request) {
 	users := []User{}
-	err := db.Select(&users, "SELECT username, status, team, taler, reputation_points FROM users ORDER BY reputation_points DESC LIMIT 10")
+	err := db.Select(&users, "SELECT "+userColumns+" FROM users ORDER BY reputation_points DESC LIMIT 10")
 	if err != nil {
 		log.Error(err)
 		return
@@ -27,9 +63,73 @@ func GETUsers(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(users)
 }
 
+// /user
+// Registers a new user with the default status and team, responds with 409 if the user already exists.
+func POSTUser(w http.ResponseWriter, r *http.Request) {
+	user := User{}
+	err := json.NewDecoder(r.Body).Decode(&user)
+	user.Username = normalizeParameter(user.Username)
+	if err != nil || user.Username == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if user.TwitchID != nil && strings.TrimSpace(*user.TwitchID) == "" {
+		user.TwitchID = nil
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+	defer tx.Rollback()
+
+	if user.TwitchID != nil {
+		var exists bool
+		err = tx.Get(&exists, "SELECT EXISTS (SELECT 1 FROM users WHERE twitch_id = $1)", *user.TwitchID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Error(err)
+			return
+		}
+		if exists {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+	}
+
+	err = tx.Get(&user, `INSERT INTO users (username, twitch_id, status, team, taler, first_seen) VALUES ($1, $2, $3, $4, $5, now())
+		ON CONFLICT (username) DO NOTHING RETURNING `+userColumns,
+		user.Username, user.TwitchID, os.Getenv("NSE_USER_DEFAULT_STATUS"), os.Getenv("NSE_USER_DEFAULT_TEAM"), user.Taler)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if err == nil && user.TwitchID != nil {
+		_, err = tx.Exec("INSERT INTO user_name_history (twitch_id, username) VALUES ($1, $2) ON CONFLICT DO NOTHING", *user.TwitchID, user.Username)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	user.UsernameHistory = []UsernameChange{}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user)
+}
+
 // /user/{username}
+// /user/{username}?twitch_id={id}
+// the user is looked up by the twitch id first, the username is the fallback
 func GETUser(w http.ResponseWriter, r *http.Request) {
 	username := normalizeParameter(mux.Vars(r)["username"])
+	twitchID := strings.TrimSpace(r.URL.Query().Get("twitch_id"))
 
 	if username == "" {
 		w.WriteHeader(http.StatusBadRequest)
@@ -37,19 +137,38 @@ func GETUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user := User{}
-	err := db.Get(&user, "SELECT username, status, team, taler, reputation_points FROM users WHERE username = $1", username)
+	err := sql.ErrNoRows
+	if twitchID != "" {
+		err = db.Get(&user, "SELECT "+userColumns+" FROM users WHERE twitch_id = $1", twitchID)
+	}
+	if err == sql.ErrNoRows {
+		err = db.Get(&user, "SELECT "+userColumns+" FROM users WHERE username = $1", username)
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		log.Error(err)
 		return
 	}
 
+	user.UsernameHistory = []UsernameChange{}
+	if user.TwitchID != nil {
+		err = db.Select(&user.UsernameHistory, "SELECT username, changed_at FROM user_name_history WHERE twitch_id = $1 ORDER BY changed_at", *user.TwitchID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Error(err)
+			return
+		}
+	}
+
 	json.NewEncoder(w).Encode(user)
 }
 
 // /user/{username}
-// /user/{username}/taler
-// /user/{username}/reputation_points
+// /user/{username}/taler?taler={amount}
+// /user/{username}/reputation_points?reputation_points={amount}
+// /user/{username}/activity
+// taler and reputation points are added to the current balance, unknown users are created
+// all endpoints accept ?twitch_id={id} to follow renames of the user
 func PUTUser(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	username := normalizeParameter(params["username"])
@@ -60,18 +179,251 @@ func PUTUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the rename of the user and the change have to be applied together,
+	// otherwise a failure could leave the previous owner of the username renamed
+	tx, err := db.Beginx()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+	defer tx.Rollback()
+
+	username, err = resolveUsername(tx, username, strings.TrimSpace(r.URL.Query().Get("twitch_id")))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
 	switch subTarget {
 	case "status":
 
 	case "team":
 
-	case "taler":
+	case "taler", "reputation_points":
+		amount, err := strconv.Atoi(r.URL.Query().Get(subTarget))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 
-	case "reputation_points":
+		err = addToBalance(tx, username, subTarget, amount)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Error(err)
+			return
+		}
+
+	case "activity":
+		activity := UserActivity{}
+		err := json.NewDecoder(r.Body).Decode(&activity)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		err = recordActivity(tx, username, activity)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Error(err)
+			return
+		}
 
 	case "":
 
 	default:
 		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
 	}
 }
+
+// addToBalance adds amount to the taler or reputation_points of the user
+// and creates the user if it does not exist yet
+func addToBalance(e sqlx.Execer, username string, balance string, amount int) error {
+	if balance != "taler" && balance != "reputation_points" {
+		return errors.New("unknown balance " + balance)
+	}
+
+	_, err := e.Exec("INSERT INTO users (username, "+balance+") VALUES ($1, $2) ON CONFLICT (username) DO UPDATE SET "+balance+" = users."+balance+" + $2", username, amount)
+	return err
+}
+
+// recordActivity adds the activity to the statistics of the user and creates the user if it does not exist yet
+// The statements should run in a transaction.
+func recordActivity(e sqlx.Execer, username string, activity UserActivity) error {
+	if activity.SeenAt.IsZero() {
+		activity.SeenAt = time.Now()
+	}
+
+	_, err := e.Exec(`INSERT INTO users (username, first_seen, last_seen, message_count, command_count, bits_total, subs_gifted, months_subscribed)
+		VALUES ($1, $2, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (username) DO UPDATE SET
+			first_seen = COALESCE(users.first_seen, $2),
+			last_seen = GREATEST(users.last_seen, $2),
+			message_count = users.message_count + $3,
+			command_count = users.command_count + $4,
+			bits_total = users.bits_total + $5,
+			subs_gifted = users.subs_gifted + $6,
+			months_subscribed = GREATEST(users.months_subscribed, $7)`,
+		username, activity.SeenAt, activity.Messages, activity.Commands, activity.Bits, activity.SubsGifted, activity.MonthsSubscribed)
+	if err != nil {
+		return err
+	}
+
+	if activity.StreamSessionID > 0 {
+		res, err := e.Exec("INSERT INTO user_stream_sessions (username, stream_session_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", username, activity.StreamSessionID)
+		if err != nil {
+			return err
+		}
+
+		// the user attended a new stream
+		if rows, _ := res.RowsAffected(); rows > 0 {
+			_, err = e.Exec("UPDATE users SET streams_attended = streams_attended + 1 WHERE username = $1", username)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// resolveUsername returns the current username of the user with the twitch id.
+// The user is renamed if the twitch username changed and the twitch id is stored
+// for users which were only known by their username.
+func resolveUsername(e sqlx.Ext, username string, twitchID string) (string, error) {
+	if twitchID == "" {
+		return username, nil
+	}
+
+	var current string
+	err := sqlx.Get(e, &current, "SELECT username FROM users WHERE twitch_id = $1", twitchID)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	if current == username {
+		return username, nil
+	}
+
+	// another account had the username before, it keeps its data under a
+	// placeholder until it shows up with its new username
+	_, err = e.Exec("UPDATE users SET username = '~' || twitch_id WHERE username = $1 AND twitch_id <> $2", username, twitchID)
+	if err != nil {
+		return "", err
+	}
+
+	if current == "" {
+		// first time we see the twitch id, claim the user with the username or create a new one
+		_, err = e.Exec("INSERT INTO users (username, twitch_id) VALUES ($1, $2) ON CONFLICT (username) DO UPDATE SET twitch_id = $2", username, twitchID)
+	} else {
+		var exists bool
+		err = sqlx.Get(e, &exists, "SELECT EXISTS (SELECT 1 FROM users WHERE username = $1)", username)
+		if err != nil {
+			return "", err
+		}
+
+		if exists {
+			// the user has to be merged with /user/{username}/merge
+			log.Warn("User ", current, " (", twitchID, ") was renamed to ", username, " which already exists")
+			return current, nil
+		}
+
+		_, err = e.Exec("UPDATE users SET username = $1 WHERE twitch_id = $2", username, twitchID)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	_, err = e.Exec("INSERT INTO user_name_history (twitch_id, username) VALUES ($1, $2) ON CONFLICT (twitch_id, username) DO UPDATE SET changed_at = now()", twitchID, username)
+	if err != nil {
+		return "", err
+	}
+
+	return username, nil
+}
+
+// /user/{username}/merge?from={username}
+// Merges the balances and statistics of the duplicate user into the user and deletes the duplicate.
+func POSTUserMerge(w http.ResponseWriter, r *http.Request) {
+	username := normalizeParameter(mux.Vars(r)["username"])
+	from := normalizeParameter(r.URL.Query().Get("from"))
+
+	if username == "" || from == "" || username == from {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+	defer tx.Rollback()
+
+	user, duplicate := User{}, User{}
+	err = tx.Get(&user, "SELECT "+userColumns+" FROM users WHERE username = $1 FOR UPDATE", username)
+	if err == nil {
+		err = tx.Get(&duplicate, "SELECT "+userColumns+" FROM users WHERE username = $1 FOR UPDATE", from)
+	}
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	// two different twitch accounts are never merged
+	if user.TwitchID != nil && duplicate.TwitchID != nil && *user.TwitchID != *duplicate.TwitchID {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	_, err = tx.Exec("INSERT INTO user_stream_sessions (username, stream_session_id) SELECT $1, stream_session_id FROM user_stream_sessions WHERE username = $2 ON CONFLICT DO NOTHING", username, from)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM users WHERE username = $1", from)
+	}
+	if err == nil {
+		_, err = tx.Exec(`UPDATE users SET
+			twitch_id = COALESCE(twitch_id, $2),
+			status = COALESCE(NULLIF(status, ''), $3),
+			team = COALESCE(NULLIF(team, ''), $4),
+			taler = taler + $5,
+			reputation_points = reputation_points + $6,
+			first_seen = LEAST(first_seen, $7),
+			last_seen = GREATEST(last_seen, $8),
+			message_count = message_count + $9,
+			command_count = command_count + $10,
+			streams_attended = (SELECT COUNT(*) FROM user_stream_sessions WHERE username = $1),
+			bits_total = bits_total + $11,
+			subs_gifted = subs_gifted + $12,
+			months_subscribed = GREATEST(months_subscribed, $13)
+			WHERE username = $1`,
+			username, duplicate.TwitchID, duplicate.Status, duplicate.Team, duplicate.Taler, duplicate.ReputationPoints,
+			duplicate.FirstSeen, duplicate.LastSeen, duplicate.MessageCount, duplicate.CommandCount,
+			duplicate.BitsTotal, duplicate.SubsGifted, duplicate.MonthsSubscribed)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
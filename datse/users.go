@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+type UserLookup struct {
+	Username string
+	TwitchID string
+}
+
+type UserLookupResult struct {
+	Username string
+	TwitchID string
+	Found    bool
+	User     *User
+}
+
+type BalanceChange struct {
+	Username         string
+	TwitchID         string
+	Taler            int
+	ReputationPoints int
+}
+
+type BalanceChangeResult struct {
+	Username         string
+	TwitchID         string
+	Error            string
+	Taler            int
+	ReputationPoints int
+}
+
+type UserActivityChange struct {
+	Username string
+	TwitchID string
+	UserActivity
+}
+
+type UserActivityChangeResult struct {
+	Username string
+	TwitchID string
+	Error    string
+}
+
+// /users/lookup
+// Looks up many users at once, users are found by their twitch id first and by their username second.
+// The results are in the order of the request.
+func POSTUsersLookup(w http.ResponseWriter, r *http.Request) {
+	lookups := []UserLookup{}
+	err := json.NewDecoder(r.Body).Decode(&lookups)
+	if err != nil || len(lookups) > envInt("NSE_BATCH_LIMIT", 500) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var usernames, twitchIDs []string
+	for i := range lookups {
+		lookups[i].Username = normalizeParameter(lookups[i].Username)
+		lookups[i].TwitchID = strings.TrimSpace(lookups[i].TwitchID)
+		usernames = append(usernames, lookups[i].Username)
+		if lookups[i].TwitchID != "" {
+			twitchIDs = append(twitchIDs, lookups[i].TwitchID)
+		}
+	}
+
+	users := []User{}
+	err = db.Select(&users, "SELECT "+userColumns+" FROM users WHERE username = ANY($1) OR twitch_id = ANY($2)", pq.Array(usernames), pq.Array(twitchIDs))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	byUsername := make(map[string]*User)
+	byTwitchID := make(map[string]*User)
+	for i := range users {
+		byUsername[users[i].Username] = &users[i]
+		if users[i].TwitchID != nil {
+			byTwitchID[*users[i].TwitchID] = &users[i]
+		}
+	}
+
+	results := []UserLookupResult{}
+	for _, lookup := range lookups {
+		user, ok := byTwitchID[lookup.TwitchID]
+		if !ok {
+			user, ok = byUsername[lookup.Username]
+		}
+
+		results = append(results, UserLookupResult{
+			Username: lookup.Username,
+			TwitchID: lookup.TwitchID,
+			Found:    ok,
+			User:     user,
+		})
+	}
+
+	json.NewEncoder(w).Encode(results)
+}
+
+// /users/balances
+// Adds the taler and reputation points of all changes in one transaction, unknown users are created.
+// Invalid or failing changes are skipped, so they can not block the others. The results contain
+// the new balances or the error of each change in the order of the request.
+func POSTUsersBalances(w http.ResponseWriter, r *http.Request) {
+	changes := []BalanceChange{}
+	err := json.NewDecoder(r.Body).Decode(&changes)
+	if err != nil || len(changes) > envInt("NSE_BATCH_LIMIT", 500) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	results := make([]BalanceChangeResult, len(changes))
+	for i := range changes {
+		changes[i].Username = normalizeParameter(changes[i].Username)
+		changes[i].TwitchID = strings.TrimSpace(changes[i].TwitchID)
+		results[i].Username = changes[i].Username
+		results[i].TwitchID = changes[i].TwitchID
+
+		if changes[i].Username == "" {
+			results[i].Error = "username is missing"
+		}
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+	defer tx.Rollback()
+
+	for i, change := range changes {
+		if results[i].Error != "" {
+			continue
+		}
+
+		// a failing change only rolls back its own statements
+		_, err := tx.Exec("SAVEPOINT balance_change")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Error(err)
+			return
+		}
+
+		username, err := resolveUsername(tx, change.Username, change.TwitchID)
+		if err == nil {
+			err = addToBalance(tx, username, "taler", change.Taler)
+		}
+		if err == nil {
+			err = addToBalance(tx, username, "reputation_points", change.ReputationPoints)
+		}
+		if err == nil {
+			results[i].Username = username
+			err = tx.QueryRowx("SELECT taler, reputation_points FROM users WHERE username = $1", username).Scan(&results[i].Taler, &results[i].ReputationPoints)
+		}
+		if err != nil {
+			log.Error("Balance change of ", change.Username, ": ", err)
+			results[i].Error = err.Error()
+			_, err = tx.Exec("ROLLBACK TO SAVEPOINT balance_change")
+		} else {
+			_, err = tx.Exec("RELEASE SAVEPOINT balance_change")
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Error(err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(results)
+}
+
+// /users/activity
+// Adds the activities of many users in one transaction, unknown users are created.
+// Invalid or failing activities are skipped, so they can not block the others.
+// The results contain the error of each activity in the order of the request.
+func POSTUsersActivity(w http.ResponseWriter, r *http.Request) {
+	changes := []UserActivityChange{}
+	err := json.NewDecoder(r.Body).Decode(&changes)
+	if err != nil || len(changes) > envInt("NSE_BATCH_LIMIT", 500) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	results := make([]UserActivityChangeResult, len(changes))
+	for i := range changes {
+		changes[i].Username = normalizeParameter(changes[i].Username)
+		changes[i].TwitchID = strings.TrimSpace(changes[i].TwitchID)
+		results[i].Username = changes[i].Username
+		results[i].TwitchID = changes[i].TwitchID
+
+		if changes[i].Username == "" {
+			results[i].Error = "username is missing"
+		}
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+	defer tx.Rollback()
+
+	for i, change := range changes {
+		if results[i].Error != "" {
+			continue
+		}
+
+		// a failing activity only rolls back its own statements
+		_, err := tx.Exec("SAVEPOINT user_activity")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Error(err)
+			return
+		}
+
+		username, err := resolveUsername(tx, change.Username, change.TwitchID)
+		if err == nil {
+			results[i].Username = username
+			err = recordActivity(tx, username, change.UserActivity)
+		}
+		if err != nil {
+			log.Error("Activity of ", change.Username, ": ", err)
+			results[i].Error = err.Error()
+			_, err = tx.Exec("ROLLBACK TO SAVEPOINT user_activity")
+		} else {
+			_, err = tx.Exec("RELEASE SAVEPOINT user_activity")
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Error(err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(results)
+}